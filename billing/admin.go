@@ -1,11 +1,14 @@
 package billing
 
 import (
+	"fmt"
 	"html/template"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
+	"appengine"
 	"appengine/blobstore"
 	"appengine/datastore"
 	"appengine/user"
@@ -38,48 +41,36 @@ func adminOnly(next myHandler) myHandler {
 }
 
 type DashboardHomePage struct {
-	Users     []*User
-	Companies []*Company
-	Vendors   []*Vendor
+	Users        []*User
+	Vendors      []*Vendor
+	UsersPager   *Pager
+	VendorsPager *Pager
 }
 
 func handleAdminDashboard(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	companies, err := ctx.GetAllCompanies()
+	up := NewPager(r.URL.Query(), "users_", 10)
+	users, err := ctx.GetAllUsers(up)
 	if err != nil {
 		return err
 	}
 
-	users, err := ctx.GetAllUsers()
+	err = ctx.LoadUserCompanies(users)
 	if err != nil {
 		return err
 	}
 
-	vendors, err := ctx.GetAllVendors()
+	vp := NewPager(r.URL.Query(), "vendors_", 10)
+	vendors, err := ctx.GetAllVendors(vp)
 	if err != nil {
 		return err
 	}
 
-	// associate companies with users ...
-	// if there are more than 10 companies this wont work because we limit our companies to 10 in GetAll
-	for _, user := range users {
-		for _, c := range companies {
-			if user.CompanyKey.Encode() == c.ID {
-				user.Company = c
-			}
-		}
-	}
-
-	// associate companies with vendors ...
-	// if there are more than 10 companies this wont work because we limit our companies to 10 in GetAll
-	for _, vendor := range vendors {
-		for _, c := range companies {
-			if vendor.CompanyKey.Encode() == c.ID {
-				vendor.Company = c
-			}
-		}
+	err = ctx.LoadVendorCompanies(vendors)
+	if err != nil {
+		return err
 	}
 
-	return ctx.renderAdmin(adminDashTmpl, DashboardHomePage{users, companies, vendors})
+	return ctx.renderAdmin(adminDashTmpl, DashboardHomePage{users, vendors, up, vp})
 }
 
 func handleNewCompany(ctx *Context, w http.ResponseWriter, r *http.Request) error {
@@ -96,7 +87,7 @@ func handleCreateCompany(ctx *Context, w http.ResponseWriter, r *http.Request) e
 	}
 
 	key := datastore.NewIncompleteKey(ctx.c, "Company", defaultCompanyKey(ctx.c))
-	_, err := datastore.Put(ctx.c, key, &comp)
+	_, err := ctx.putAudited(key, nil, &comp)
 
 	if err != nil {
 		return err
@@ -110,6 +101,7 @@ type NewUserForm struct {
 	User           *User
 	ValidationErrs []string
 	Companies      []*Company
+	Roles          []Role
 }
 
 func handleCreateUser(ctx *Context, w http.ResponseWriter, r *http.Request) error {
@@ -144,24 +136,30 @@ func handleCreateUser(ctx *Context, w http.ResponseWriter, r *http.Request) erro
 		}
 	}
 
+	userRoles := validRoles(r.Form["roles"])
+	if len(userRoles) == 0 {
+		vErrs = append(vErrs, "You must select at least one role")
+	}
+
 	user := User{
 		CompanyKey: companyKey,
 		Email:      email,
+		Roles:      userRoles,
 		CreatedOn:  time.Now(),
 		CreatedBy:  ctx.user.String(),
 	}
 
 	if len(vErrs) > 0 {
-		companies, err := ctx.GetAllCompanies()
+		companies, err := ctx.GetAllCompanies(nil)
 		if err != nil {
 			return err
 		}
-		ctx.renderAdmin(newUserTmpl, NewUserForm{&user, vErrs, companies})
+		ctx.renderAdmin(newUserTmpl, NewUserForm{&user, vErrs, companies, roles})
 		return nil
 	}
 
 	key := datastore.NewIncompleteKey(ctx.c, "User", companyKey)
-	_, err = datastore.Put(ctx.c, key, &user)
+	_, err = ctx.putAudited(key, nil, &user)
 
 	if err != nil {
 		return err
@@ -172,17 +170,28 @@ func handleCreateUser(ctx *Context, w http.ResponseWriter, r *http.Request) erro
 }
 
 func handleNewUser(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	companies, err := ctx.GetAllCompanies()
+	companies, err := ctx.GetAllCompanies(nil)
 	if err != nil {
 		return err
 	}
-	return ctx.renderAdmin(newUserTmpl, NewUserForm{&User{}, []string{}, companies})
+	return ctx.renderAdmin(newUserTmpl, NewUserForm{&User{Roles: []string{RoleViewer}}, []string{}, companies, roles})
 }
 
+// VendorOptions are the choices offered for the details of a vendor.
+type VendorOptions struct {
+	Categories   []ExpenseCategory
+	Methods      []PaymentMethod
+	AccountTypes []AccountType
+}
+
+var vendorOptions = VendorOptions{expenseCategories, paymentMethods, accountTypes}
+
 type NewVendorForm struct {
 	Vendor         *Vendor
 	ValidationErrs []string
 	Companies      []*Company
+	Terms          []PaymentTerms
+	Options        VendorOptions
 }
 
 func handleCreateVendor(ctx *Context, w http.ResponseWriter, r *http.Request) error {
@@ -197,6 +206,12 @@ func handleCreateVendor(ctx *Context, w http.ResponseWriter, r *http.Request) er
 		vErrs = append(vErrs, "Name must be valid")
 	}
 
+	terms := r.FormValue("terms")
+
+	if _, ok := findPaymentTerms(terms); !ok {
+		vErrs = append(vErrs, "You must select payment terms")
+	}
+
 	companyID := r.FormValue("company")
 
 	if companyID == "" {
@@ -211,21 +226,25 @@ func handleCreateVendor(ctx *Context, w http.ResponseWriter, r *http.Request) er
 	vendor := Vendor{
 		CompanyKey: companyKey,
 		Name:       name,
+		Terms:      terms,
 		CreatedOn:  time.Now(),
 		CreatedBy:  ctx.user.String(),
 	}
 
+	readVendorDetails(&vendor, r.Form)
+	vErrs = append(vErrs, vendor.ValidateDetails()...)
+
 	if len(vErrs) > 0 {
-		companies, err := ctx.GetAllCompanies()
+		companies, err := ctx.GetAllCompanies(nil)
 		if err != nil {
 			return err
 		}
-		ctx.renderAdmin(newVendorTmpl, NewVendorForm{&vendor, vErrs, companies})
+		ctx.renderAdmin(newVendorTmpl, NewVendorForm{&vendor, vErrs, companies, paymentTerms, vendorOptions})
 		return nil
 	}
 
 	key := datastore.NewIncompleteKey(ctx.c, "Vendor", companyKey)
-	_, err = datastore.Put(ctx.c, key, &vendor)
+	_, err = ctx.putAudited(key, nil, &vendor)
 
 	if err != nil {
 		return err
@@ -234,12 +253,158 @@ func handleCreateVendor(ctx *Context, w http.ResponseWriter, r *http.Request) er
 	return ctx.Redirect("/admin/dashboard")
 }
 
+type EditCompanyForm struct {
+	Company        *Company
+	ValidationErrs []string
+}
+
+func handleEditCompany(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	c, err := ctx.GetCompanyByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	if r.Method != "POST" {
+		return ctx.renderAdmin(editCompanyTmpl, EditCompanyForm{c, []string{}})
+	}
+
+	c.Name = strings.TrimSpace(r.FormValue("name"))
+	if c.Name == "" {
+		return ctx.renderAdmin(editCompanyTmpl, EditCompanyForm{c, []string{"Name must be valid"}})
+	}
+
+	err = ctx.UpdateCompany(c.Key, c.Name)
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Company %s updated", c.Name)
+	return ctx.Redirect("/admin/company/view?id=" + c.ID)
+}
+
+func handleDeleteCompany(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return ctx.Redirect("/admin/companies")
+	}
+
+	c, err := ctx.GetCompanyByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	err = ctx.DeleteCompany(c.Key)
+	if ierr, ok := err.(InUseError); ok {
+		ctx.Flash("%s", ierr.Error())
+		return ctx.Redirect("/admin/company/view?id=" + c.ID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Company %s moved to the Trash", c.Name)
+	return ctx.Redirect("/admin/companies")
+}
+
 func handleNewVendor(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	companies, err := ctx.GetAllCompanies()
+	companies, err := ctx.GetAllCompanies(nil)
+	if err != nil {
+		return err
+	}
+	return ctx.renderAdmin(newVendorTmpl, NewVendorForm{&Vendor{Terms: defaultTermsCode}, []string{}, companies, paymentTerms, vendorOptions})
+}
+
+type EditVendorForm struct {
+	Vendor         *Vendor
+	ValidationErrs []string
+	Terms          []PaymentTerms
+	Options        VendorOptions
+}
+
+// handleEditVendor changes the name, terms and details of a vendor.  The
+// new terms apply to bills created afterwards and a change of bank details
+// waits for confirmation.  A vendor's company is part of its key and cannot
+// be changed.
+func handleEditVendor(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := ctx.GetVendorByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	if r.Method != "POST" {
+		return ctx.renderAdmin(editVendorTmpl, EditVendorForm{v, []string{}, paymentTerms, vendorOptions})
+	}
+
+	vErrs := []string{}
+
+	v.Name = strings.TrimSpace(r.FormValue("name"))
+	if v.Name == "" {
+		vErrs = append(vErrs, "Name must be valid")
+	}
+
+	v.Terms = r.FormValue("terms")
+	if _, ok := findPaymentTerms(v.Terms); !ok {
+		vErrs = append(vErrs, "You must select payment terms")
+	}
+
+	bank := v.Bank
+	readVendorDetails(v, r.Form)
+	vErrs = append(vErrs, v.ValidateDetails()...)
+
+	if len(vErrs) > 0 {
+		return ctx.renderAdmin(editVendorTmpl, EditVendorForm{v, vErrs, paymentTerms, vendorOptions})
+	}
+
+	err = ctx.UpdateVendor(v.Key, v)
+	if ierr, ok := err.(InUseError); ok {
+		return ctx.renderAdmin(editVendorTmpl, EditVendorForm{v, []string{ierr.Error()}, paymentTerms, vendorOptions})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if v.Bank != bank {
+		ctx.Flash("Vendor %s updated. The new bank details must be confirmed by another user, and payments to the vendor are on hold until then", v.Name)
+		return ctx.Redirect("/admin/vendor/view?id=" + v.ID)
+	}
+
+	ctx.Flash("Vendor %s updated", v.Name)
+	return ctx.Redirect("/admin/vendors")
+}
+
+func handleDeleteVendor(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return ctx.Redirect("/admin/vendors")
+	}
+
+	v, err := ctx.GetVendorByID(r.FormValue("id"))
 	if err != nil {
 		return err
 	}
-	return ctx.renderAdmin(newVendorTmpl, NewVendorForm{&Vendor{}, []string{}, companies})
+
+	err = ctx.DeleteVendor(v.Key)
+	if ierr, ok := err.(InUseError); ok {
+		ctx.Flash("%s", ierr.Error())
+		return ctx.Redirect("/admin/vendors")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Vendor %s moved to the Trash", v.Name)
+	return ctx.Redirect("/admin/vendors")
+}
+
+// CompanyPage is a company along with the pagers for the lists shown on
+// its page.
+type CompanyPage struct {
+	*Company
+	UsersPager   *Pager
+	VendorsPager *Pager
+	BillsPager   *Pager
+	DutyRules    []DutyRule
 }
 
 func handleViewCompany(ctx *Context, w http.ResponseWriter, r *http.Request) error {
@@ -249,24 +414,34 @@ func handleViewCompany(ctx *Context, w http.ResponseWriter, r *http.Request) err
 		return err
 	}
 
-	users, err := ctx.GetCompanyUsers(c)
+	up := NewPager(r.URL.Query(), "users_", 20)
+	users, err := ctx.GetCompanyUsers(c, up)
 	if err != nil {
 		return err
 	}
 
-	vendors, err := ctx.GetCompanyVendors(c)
+	vp := NewPager(r.URL.Query(), "vendors_", 20)
+	vendors, err := ctx.GetCompanyVendors(c, vp)
+	if err != nil {
+		return err
+	}
+
+	bp := NewPager(r.URL.Query(), "bills_", 20)
+	bills, err := ctx.GetCompanyUnreconciledBills(c, bp)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.LoadBillVendors(bills)
 	if err != nil {
 		return err
 	}
 
 	c.Users = users
 	c.Vendors = vendors
+	c.Bills = bills
 
-	return ctx.renderAdmin(viewCompanyTmpl, c)
-}
-
-func handleViewVendor(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	return ctx.renderAdmin(viewVendorTmpl, nil)
+	return ctx.renderAdmin(viewCompanyTmpl, CompanyPage{c, up, vp, bp, dutyRules})
 }
 
 func handleDeleteUser(ctx *Context, w http.ResponseWriter, r *http.Request) error {
@@ -283,7 +458,7 @@ func handleDeleteUser(ctx *Context, w http.ResponseWriter, r *http.Request) erro
 		return err
 	}
 
-	ctx.Flash("User %s deleted!", u.Email)
+	ctx.Flash("User %s moved to the Trash", u.Email)
 
 	return ctx.Redirect("/admin/dashboard")
 }
@@ -325,16 +500,29 @@ func (ctx *Context) renderAdmin(t *template.Template, content interface{}) error
 	return ctx.Render(t, DashboardPage{di, content})
 }
 
+type AdminCompaniesPage struct {
+	Companies []*Company
+	Pager     *Pager
+}
+
 func handleAdminCompanies(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	companies, err := ctx.GetAllCompanies()
+	p := NewPager(r.URL.Query(), "", 10)
+	companies, err := ctx.GetAllCompanies(p)
 	if err != nil {
 		return err
 	}
-	return ctx.renderAdmin(viewCompanies, companies)
+	return ctx.renderAdmin(viewCompanies, AdminCompaniesPage{companies, p})
+}
+
+type AdminUsersPage struct {
+	Users []*User
+	Roles []Role
+	Pager *Pager
 }
 
 func handleAdminUsers(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	users, err := ctx.GetAllUsers()
+	p := NewPager(r.URL.Query(), "", 10)
+	users, err := ctx.GetAllUsers(p)
 	if err != nil {
 		return err
 	}
@@ -344,11 +532,42 @@ func handleAdminUsers(ctx *Context, w http.ResponseWriter, r *http.Request) erro
 		return err
 	}
 
-	return ctx.renderAdmin(viewUsers, users)
+	return ctx.renderAdmin(viewUsers, AdminUsersPage{users, roles, p})
+}
+
+func handleAdminUserRoles(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return ctx.Redirect("/admin/users")
+	}
+
+	u, err := ctx.GetUserByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	userRoles := validRoles(r.Form["roles"])
+	if len(userRoles) == 0 {
+		ctx.Flash("Users must have at least one role.")
+		return ctx.Redirect("/admin/users")
+	}
+
+	err = ctx.SetUserRoles(u, userRoles)
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Roles updated for %s", u.Email)
+	return ctx.Redirect("/admin/users")
+}
+
+type AdminVendorsPage struct {
+	Vendors []*Vendor
+	Pager   *Pager
 }
 
 func handleAdminVendors(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	vendors, err := ctx.GetAllVendors()
+	p := NewPager(r.URL.Query(), "", 10)
+	vendors, err := ctx.GetAllVendors(p)
 	if err != nil {
 		return err
 	}
@@ -358,14 +577,32 @@ func handleAdminVendors(ctx *Context, w http.ResponseWriter, r *http.Request) er
 		return err
 	}
 
-	return ctx.renderAdmin(viewVendors, vendors)
+	return ctx.renderAdmin(viewVendors, AdminVendorsPage{vendors, p})
+}
+
+type AdminBillsPage struct {
+	Bills     []*Bill
+	Filter    *BillFilter
+	Pager     *Pager
+	Companies []*Company
+	Vendors   []*Vendor
 }
 
 func handleAdminBills(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	//ctx.GetAllBills().FetchVendor().FetchCompany().Slice()
-	//tmpl("viewBills").Render(results)
+	f := NewBillFilter(r.URL.Query())
+	p := NewPager(r.URL.Query(), "", 10)
+
+	bills, err := ctx.FilterBills(f, p)
+	if err != nil {
+		return err
+	}
 
-	bills, err := ctx.GetAllBills()
+	companies, err := ctx.GetAllCompanies(nil)
+	if err != nil {
+		return err
+	}
+
+	vendors, err := ctx.GetAllVendors(nil)
 	if err != nil {
 		return err
 	}
@@ -375,12 +612,12 @@ func handleAdminBills(ctx *Context, w http.ResponseWriter, r *http.Request) erro
 		return err
 	}
 
-	ctx.LoadBillVendors(bills)
+	err = ctx.LoadBillVendors(bills)
 	if err != nil {
 		return err
 	}
 
-	return ctx.renderAdmin(viewBills, bills)
+	return ctx.renderAdmin(viewBills, AdminBillsPage{bills, f, p, companies, vendors})
 }
 
 type NewBillForm struct {
@@ -390,26 +627,54 @@ type NewBillForm struct {
 	UploadURL      *url.URL
 }
 
-func renderBillForm(ctx *Context, errs []string) error {
+func renderBillForm(ctx *Context, b *Bill, errs []string) error {
 	uploadURL, err := blobstore.UploadURL(ctx.c, "/admin/bill/create", nil)
 	if err != nil {
 		return err
 	}
 
-	vendors, err := ctx.GetAllVendors()
+	vendors, err := ctx.GetAllVendors(nil)
 	if err != nil {
 		return err
 	}
-	return ctx.renderAdmin(newBillTmpl, NewBillForm{&Bill{}, errs, vendors, uploadURL})
+	return ctx.renderAdmin(newBillTmpl, NewBillForm{b, errs, vendors, uploadURL})
 }
 
 func handleNewBill(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	return renderBillForm(ctx, []string{})
+	return renderBillForm(ctx, &Bill{}, []string{})
 }
 
-func handleCreateBill(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	errs := []string{}
+// newBillFromUpload builds a bill from the invoice fields of a blobstore
+// upload.
+func newBillFromUpload(blobs map[string][]*blobstore.BlobInfo, fields url.Values) *Bill {
+	b := &Bill{
+		Amt:        getFormFieldMoney(fields, "amount"),
+		InvoiceNum: strings.TrimSpace(getFormFieldString(fields, "invoice")),
+		Date:       getFormFieldDate(fields, "date"),
+		DueOn:      getFormFieldDate(fields, "due_on"),
+	}
+
+	if file := blobs["file"]; len(file) > 0 {
+		b.BlobKey = file[0].BlobKey
+	}
+
+	return b
+}
+
+// discardUpload removes an uploaded bill file that will not be saved.
+func (ctx *Context) discardUpload(b *Bill) {
+	if b.BlobKey == "" {
+		return
+	}
+
+	err := blobstore.Delete(ctx.c, b.BlobKey)
+	if err != nil {
+		ctx.c.Errorf("could not delete bill file %s: %v", b.BlobKey, err)
+	}
+	b.BlobKey = ""
+}
 
+func handleCreateBill(ctx *Context, w http.ResponseWriter, r *http.Request) error {
 	blobs, fields, err := blobstore.ParseUpload(ctx.r)
 
 	ctx.Debugf("Blobs: %v", blobs)
@@ -418,9 +683,11 @@ func handleCreateBill(ctx *Context, w http.ResponseWriter, r *http.Request) erro
 		return err
 	}
 
-	//vendor := getFormFieldString(fields, "vendor")
-	amt := getFormFieldInt(fields, "amount")
-	if amt <= 0 {
+	b := newBillFromUpload(blobs, fields)
+
+	errs := b.ValidateInvoice()
+
+	if b.Amt <= 0 {
 		errs = append(errs, "Amount must be greater than 0")
 	}
 
@@ -429,32 +696,62 @@ func handleCreateBill(ctx *Context, w http.ResponseWriter, r *http.Request) erro
 		errs = append(errs, "You must choose a vendor for the bill")
 	}
 
-	file := blobs["file"]
-	if len(file) == 0 {
+	if b.BlobKey == "" {
 		errs = append(errs, "You must upload a bill file")
 	}
 
-	if len(errs) > 0 {
-		return renderBillForm(ctx, errs)
+	var v *Vendor
+	if vendorID != "" {
+		v, err = ctx.GetVendorByID(vendorID)
+		if err != nil {
+			ctx.discardUpload(b)
+			return err
+		}
+
+		if v.Deleted {
+			ctx.discardUpload(b)
+			return datastore.ErrNoSuchEntity
+		}
+
+		b.VendorKey = v.Key
+		b.applyTerms(v.Terms)
+
+		if b.InvoiceNum != "" {
+			found, err := ctx.InvoiceExists(v.Key, b.InvoiceNum)
+			if err != nil {
+				ctx.discardUpload(b)
+				return err
+			}
+
+			if found {
+				errs = append(errs, "This vendor already has a bill with that invoice number")
+			}
+		}
 	}
 
-	v, err := ctx.GetVendorByID(vendorID)
+	if b.DueOn.IsZero() {
+		b.DueOn = b.Date
+	}
 
+	if len(errs) > 0 {
+		ctx.discardUpload(b)
+		return renderBillForm(ctx, b, errs)
+	}
+
+	company := new(Company)
+	err = datastore.Get(ctx.c, v.CompanyKey, company)
 	if err != nil {
+		ctx.discardUpload(b)
 		return err
 	}
 
-	b := Bill{
-		Amt:        amt,
-		PostedOn:   time.Now(),
-		VendorKey:  v.Key,
-		CompanyKey: v.CompanyKey,
-		PostedBy:   ctx.user.String(),
-		BlobKey:    file[0].BlobKey,
-	}
+	b.PostedOn = time.Now()
+	b.PostedBy = ctx.user.String()
+	b.CompanyKey = v.CompanyKey
+	b.startApproval(company)
 
 	key := datastore.NewIncompleteKey(ctx.c, "Bill", v.CompanyKey)
-	_, err = datastore.Put(ctx.c, key, &b)
+	_, err = ctx.putAudited(key, nil, b)
 	if err != nil {
 		return err
 	}
@@ -462,18 +759,361 @@ func handleCreateBill(ctx *Context, w http.ResponseWriter, r *http.Request) erro
 	return ctx.Redirect("/admin/bills")
 }
 
+func renderBillEditForm(ctx *Context, b *Bill, errs []string) error {
+	uploadURL, err := blobstore.UploadURL(ctx.c, "/admin/bill/update", nil)
+	if err != nil {
+		return err
+	}
+
+	vendors, err := ctx.GetCompanyVendors(&Company{Key: b.CompanyKey}, nil)
+	if err != nil {
+		return err
+	}
+	return ctx.renderAdmin(editBillTmpl, NewBillForm{b, errs, vendors, uploadURL})
+}
+
+func handleEditBill(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	b, err := ctx.GetAuthorizedBill(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	return renderBillEditForm(ctx, b, []string{})
+}
+
+// handleUpdateBill saves the invoice fields of a bill and, if a new file was
+// uploaded, replaces the bill file.  Changing the amount or vendor sends the
+// bill back through the approval chain.
+func handleUpdateBill(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	blobs, fields, err := blobstore.ParseUpload(ctx.r)
+	if err != nil {
+		return err
+	}
+
+	upd := newBillFromUpload(blobs, fields)
+
+	b, err := ctx.GetAuthorizedBill(getFormFieldString(fields, "id"))
+	if err != nil {
+		ctx.discardUpload(upd)
+		return err
+	}
+
+	errs := upd.ValidateInvoice()
+	if upd.Amt <= 0 {
+		errs = append(errs, "Amount must be greater than 0")
+	}
+
+	if upd.Amt != b.Amt && len(b.Installments) > 0 {
+		errs = append(errs, "Remove the installment schedule before changing the amount")
+	}
+
+	v, err := ctx.GetVendorByID(getFormFieldString(fields, "vendor"))
+	if v.Key == nil {
+		errs = append(errs, "You must choose a vendor for the bill")
+	} else if err != nil {
+		ctx.discardUpload(upd)
+		return err
+	} else if v.Deleted {
+		ctx.discardUpload(upd)
+		return datastore.ErrNoSuchEntity
+	} else if !v.CompanyKey.Equal(b.CompanyKey) {
+		errs = append(errs, "The vendor must belong to the bill's company")
+	} else if upd.InvoiceNum != "" && (upd.InvoiceNum != b.InvoiceNum || !v.Key.Equal(b.VendorKey)) {
+		found, err := ctx.InvoiceExists(v.Key, upd.InvoiceNum)
+		if err != nil {
+			ctx.discardUpload(upd)
+			return err
+		}
+
+		if found {
+			errs = append(errs, "This vendor already has a bill with that invoice number")
+		}
+	}
+
+	if len(errs) > 0 {
+		ctx.discardUpload(upd)
+		b.InvoiceNum = upd.InvoiceNum
+		b.Date = upd.Date
+		b.DueOn = upd.DueOn
+		b.Amt = upd.Amt
+		b.VendorKey = v.Key
+		return renderBillEditForm(ctx, b, errs)
+	}
+
+	oldBlobKey := b.BlobKey
+
+	b, err = ctx.EditBill(b.Key, func(c appengine.Context, eb *Bill) error {
+		reapprove := eb.Amt != upd.Amt || !eb.VendorKey.Equal(v.Key)
+
+		terms := eb.Terms
+		if !eb.VendorKey.Equal(v.Key) {
+			terms = v.Terms
+		}
+
+		eb.InvoiceNum = upd.InvoiceNum
+		eb.Date = upd.Date
+		eb.DueOn = upd.DueOn
+		eb.Amt = upd.Amt
+		eb.VendorKey = v.Key
+		eb.DiscountBy = time.Time{}
+		eb.DiscountAmt = 0
+		eb.applyTerms(terms)
+		if eb.DueOn.IsZero() {
+			eb.DueOn = eb.Date
+		}
+
+		if upd.BlobKey != "" {
+			eb.BlobKey = upd.BlobKey
+		}
+
+		if !reapprove {
+			return nil
+		}
+
+		company := new(Company)
+		err := datastore.Get(c, eb.CompanyKey, company)
+		if err != nil {
+			return err
+		}
+
+		eb.startApproval(company)
+		return nil
+	})
+
+	if serr, ok := err.(BillStatusError); ok {
+		ctx.discardUpload(upd)
+		ctx.Flash("%s", serr.Error())
+		return ctx.Redirect("/admin/bills")
+	}
+
+	if err != nil {
+		ctx.discardUpload(upd)
+		return err
+	}
+
+	if upd.BlobKey != "" && oldBlobKey != "" {
+		err = blobstore.Delete(ctx.c, oldBlobKey)
+		if err != nil {
+			ctx.c.Errorf("could not delete replaced bill file %s: %v", oldBlobKey, err)
+		}
+	}
+
+	ctx.Flash("Bill updated")
+	return ctx.Redirect("/admin/bills")
+}
+
+func handleDeleteBill(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return ctx.Redirect("/admin/bills")
+	}
+
+	b, err := ctx.GetAuthorizedBill(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	err = ctx.DeleteBill(b.Key)
+	if ierr, ok := err.(InUseError); ok {
+		ctx.Flash("%s", ierr.Error())
+		return ctx.Redirect("/admin/bills")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Bill moved to the Trash")
+	return ctx.Redirect("/admin/bills")
+}
+
+var billActionMessages = map[string]string{
+	BillActionApprove:     "Bill approved",
+	BillActionReject:      "Bill rejected",
+	BillActionResubmit:    "Bill resubmitted for approval",
+	BillActionPay:         "Bill marked paid",
+	BillActionReconcile:   "Bill marked reconciled",
+	BillActionUnpay:       "Bill payment undone",
+	BillActionUnreconcile: "Bill reconciliation undone",
+}
+
+func handleAdminBillStatus(action string) myHandler {
+	return func(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "POST" {
+			return ctx.Redirect("/admin/bills")
+		}
+
+		b, err := ctx.GetAuthorizedBill(r.FormValue("id"))
+		if err != nil {
+			return err
+		}
+
+		_, err = ctx.UpdateBillStatus(b.Key, action, r.FormValue("reason"), r.FormValue("justification"))
+		if serr, ok := err.(BillStatusError); ok {
+			ctx.Flash("%s", serr.Error())
+			return ctx.Redirect("/admin/bills")
+		}
+
+		if err != nil {
+			return err
+		}
+
+		ctx.Flash("%s", billActionMessages[action])
+		return ctx.Redirect("/admin/bills")
+	}
+}
+
+type PayBillForm struct {
+	Bill           *Bill
+	Payment        *Payment
+	Payments       []*Payment
+	Methods        []PaymentMethod
+	ValidationErrs []string
+	UploadURL      *url.URL
+}
+
+func renderPayBillForm(ctx *Context, b *Bill, p *Payment, errs []string) error {
+	uploadURL, err := blobstore.UploadURL(ctx.c, "/admin/bill/pay", nil)
+	if err != nil {
+		return err
+	}
+
+	payments, err := ctx.GetBillPayments(b)
+	if err != nil {
+		return err
+	}
+
+	return ctx.renderAdmin(payBillTmpl, PayBillForm{b, p, payments, paymentMethods, errs, uploadURL})
+}
+
+func handleAdminPaymentForm(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	b, err := ctx.GetAuthorizedBill(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	p := &Payment{
+		Amt:    b.AmountDue(),
+		PaidOn: time.Now(),
+	}
+
+	return renderPayBillForm(ctx, b, p, []string{})
+}
+
+const installmentRows = 6
+
+type BillScheduleForm struct {
+	Bill           *Bill
+	Installments   []Installment
+	ValidationErrs []string
+}
+
+func renderBillScheduleForm(ctx *Context, b *Bill, installments []Installment, errs []string) error {
+	rows := make([]Installment, installmentRows)
+	copy(rows, installments)
+	return ctx.renderAdmin(billScheduleTmpl, BillScheduleForm{b, rows, errs})
+}
+
+func handleAdminBillSchedule(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	b, err := ctx.GetAuthorizedBill(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	if r.Method != "POST" {
+		return renderBillScheduleForm(ctx, b, b.Installments, []string{})
+	}
+
+	installments := []Installment{}
+	for idx := 0; idx < installmentRows; idx++ {
+		dueOn := fmt.Sprintf("due_on_%d", idx)
+		amount := fmt.Sprintf("amount_%d", idx)
+		if r.FormValue(dueOn) == "" && r.FormValue(amount) == "" {
+			continue
+		}
+
+		installments = append(installments, Installment{
+			DueOn: getFormFieldDate(r.Form, dueOn),
+			Amt:   getFormFieldMoney(r.Form, amount),
+		})
+	}
+
+	errs := validateInstallments(b, installments)
+	if len(errs) > 0 {
+		return renderBillScheduleForm(ctx, b, installments, errs)
+	}
+
+	err = ctx.SetBillInstallments(b.Key, installments)
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Installment schedule saved")
+	return ctx.Redirect("/admin/bill/payment?id=" + b.EncodedKey())
+}
+
+func handleAdminPayBill(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	blobs, fields, err := blobstore.ParseUpload(ctx.r)
+	if err != nil {
+		return err
+	}
+
+	p := newPaymentFromUpload(blobs, fields)
+
+	b, err := ctx.GetAuthorizedBill(getFormFieldString(fields, "id"))
+	if err != nil {
+		ctx.discardProof(p)
+		return err
+	}
+
+	errs := p.Validate()
+	if len(errs) > 0 {
+		ctx.discardProof(p)
+		p.ProofBlobKey = ""
+		return renderPayBillForm(ctx, b, p, errs)
+	}
+
+	_, err = ctx.PayBill(b.Key, p, getFormFieldString(fields, "justification"))
+	if serr, ok := err.(BillStatusError); ok {
+		ctx.discardProof(p)
+		ctx.Flash("%s", serr.Error())
+		return ctx.Redirect("/admin/bills")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("%s", billActionMessages[BillActionPay])
+	return ctx.Redirect("/admin/bills")
+}
+
 var (
-	adminDashTmpl   = adminTmpl("dashboard.html")
-	newCompanyTmpl  = adminTmpl("new_company.html")
-	newUserTmpl     = adminTmpl("new_user.html")
-	viewCompanyTmpl = adminTmpl("view_company.html")
-	newVendorTmpl   = adminTmpl("new_vendor.html")
-	viewVendorTmpl  = adminTmpl("view_vendor.html")
-	viewCompanies   = adminTmpl("companies.html")
-	viewUsers       = adminTmpl("users.html")
-	viewVendors     = adminTmpl("vendors.html")
-	viewBills       = adminTmpl("bills.html")
-	newBillTmpl     = adminTmpl("new_bill.html")
+	adminDashTmpl        = adminTmpl("dashboard.html")
+	newCompanyTmpl       = adminTmpl("new_company.html")
+	newUserTmpl          = adminTmpl("new_user.html")
+	viewCompanyTmpl      = adminTmpl("view_company.html")
+	newVendorTmpl        = adminTmpl("new_vendor.html")
+	viewVendorTmpl       = adminTmpl("view_vendor.html")
+	viewCompanies        = adminTmpl("companies.html")
+	viewUsers            = adminTmpl("users.html")
+	viewVendors          = adminTmpl("vendors.html")
+	viewBills            = adminTmpl("bills.html")
+	newBillTmpl          = adminTmpl("new_bill.html")
+	payBillTmpl          = adminTmpl("pay_bill.html")
+	billScheduleTmpl     = adminTmpl("bill_schedule.html")
+	agingTmpl            = adminTmpl("aging.html")
+	companyApprovalsTmpl = adminTmpl("company_approvals.html")
+	companyDutiesTmpl    = adminTmpl("company_duties.html")
+	auditTmpl            = adminTmpl("audit.html")
+	trashTmpl            = adminTmpl("trash.html")
+	editCompanyTmpl      = adminTmpl("edit_company.html")
+	editVendorTmpl       = adminTmpl("edit_vendor.html")
+	editBillTmpl         = adminTmpl("edit_bill.html")
+	offboardTmpl         = adminTmpl("offboard.html")
+	companyBankingTmpl   = adminTmpl("company_banking.html")
+	paymentsTmpl         = adminTmpl("payments.html")
+	newPaymentBatchTmpl  = adminTmpl("new_payment_batch.html")
+	paymentBatchTmpl     = adminTmpl("payment_batch.html")
 )
 
 func setupAdminRoutes(router *mux.Router) {
@@ -482,18 +1122,60 @@ func setupAdminRoutes(router *mux.Router) {
 	router.Handle("/admin/users", adminOnly(handleAdminUsers))
 	router.Handle("/admin/vendors", adminOnly(handleAdminVendors))
 	router.Handle("/admin/bills", adminOnly(handleAdminBills))
+	router.Handle("/admin/reports/aging", adminOnly(handleAdminAging))
+	router.Handle("/admin/reports/aging.csv", adminOnly(handleAdminAgingCSV))
+	router.Handle("/admin/audit", adminOnly(handleAdminAudit))
+	router.Handle("/admin/trash", adminOnly(handleAdminTrash))
+	router.Handle("/admin/trash/restore", adminOnly(handleAdminTrashAction(true)))
+	router.Handle("/admin/trash/purge", adminOnly(handleAdminTrashAction(false)))
+	router.Handle("/admin/payments", adminOnly(handleAdminPayments))
+	router.Handle("/admin/payments/new", adminOnly(handleAdminNewPaymentBatch))
+	router.Handle("/admin/payments/view", adminOnly(handleAdminPaymentBatch))
+	router.Handle("/admin/payments/nacha", adminOnly(handleAdminPaymentBatchNACHA))
+	router.Handle("/admin/payments/pain001", adminOnly(handleAdminPaymentBatchPain001))
+	router.Handle("/admin/payments/checks", adminOnly(handleAdminPaymentBatchChecks(false)))
+	router.Handle("/admin/payments/register", adminOnly(handleAdminPaymentBatchChecks(true)))
+	router.Handle("/admin/payments/positivepay", adminOnly(handleAdminPositivePay))
+	router.Handle("/admin/payments/void", adminOnly(handleAdminVoidCheck))
+	router.Handle("/admin/payments/confirm", adminOnly(handleAdminPaymentBatchAction(true)))
+	router.Handle("/admin/payments/cancel", adminOnly(handleAdminPaymentBatchAction(false)))
 	router.Handle("/admin/user/new", adminOnly(handleNewUser))
 	router.Handle("/admin/user/create", adminOnly(handleCreateUser))
 	router.Handle("/admin/user/delete", adminOnly(handleDeleteUser))
+	router.Handle("/admin/user/roles", adminOnly(handleAdminUserRoles))
 	router.Handle("/admin/company/new", adminOnly(handleNewCompany))
 	router.Handle("/admin/company/create", adminOnly(handleCreateCompany))
 	router.Handle("/admin/company/view", adminOnly(handleViewCompany))
+	router.Handle("/admin/company/edit", adminOnly(handleEditCompany))
+	router.Handle("/admin/company/delete", adminOnly(handleDeleteCompany))
+	router.Handle("/admin/company/approvals", adminOnly(handleAdminCompanyApprovals))
+	router.Handle("/admin/company/duties", adminOnly(handleAdminCompanyDuties))
+	router.Handle("/admin/company/offboard", adminOnly(handleAdminCompanyOffboard))
+	router.Handle("/admin/company/export", adminOnly(handleAdminCompanyExport))
+	router.Handle("/admin/company/banking", adminOnly(handleAdminCompanyBanking))
 
 	router.Handle("/admin/vendor/new", adminOnly(handleNewVendor))
 	router.Handle("/admin/vendor/create", adminOnly(handleCreateVendor))
 	router.Handle("/admin/vendor/view", adminOnly(handleViewVendor))
+	router.Handle("/admin/vendor/edit", adminOnly(handleEditVendor))
+	router.Handle("/admin/vendor/delete", adminOnly(handleDeleteVendor))
+	router.Handle("/admin/vendor/bank/confirm", adminOnly(handleAdminBankChange(true)))
+	router.Handle("/admin/vendor/bank/reject", adminOnly(handleAdminBankChange(false)))
 
 	router.Handle("/admin/bill/new", adminOnly(handleNewBill))
 	router.Handle("/admin/bill/create", adminOnly(handleCreateBill))
+	router.Handle("/admin/bill/edit", adminOnly(handleEditBill))
+	router.Handle("/admin/bill/update", adminOnly(handleUpdateBill))
+	router.Handle("/admin/bill/delete", adminOnly(handleDeleteBill))
+	router.Handle("/admin/bill/payment", adminOnly(handleAdminPaymentForm))
+	router.Handle("/admin/bill/pay", adminOnly(handleAdminPayBill))
+	router.Handle("/admin/bill/schedule", adminOnly(handleAdminBillSchedule))
+	router.Handle("/admin/bill/approve", adminOnly(handleAdminBillStatus(BillActionApprove)))
+	router.Handle("/admin/bill/reject", adminOnly(handleAdminBillStatus(BillActionReject)))
+	router.Handle("/admin/bill/reconcile", adminOnly(handleAdminBillStatus(BillActionReconcile)))
+	router.Handle("/admin/bill/unpay", adminOnly(handleAdminBillStatus(BillActionUnpay)))
+	router.Handle("/admin/bill/unreconcile", adminOnly(handleAdminBillStatus(BillActionUnreconcile)))
+
+	router.Handle(offboardTaskPath, myHandler(handleOffboardTask))
 
 }
@@ -0,0 +1,202 @@
+package billing
+
+import (
+	"encoding/csv"
+	"net/http"
+	"sort"
+	"time"
+
+	"appengine/datastore"
+)
+
+// AgingRow holds the outstanding balance of a group of bills split by how
+// many days past due they are.  All amounts are in cents.
+type AgingRow struct {
+	Name    string
+	Current int
+	Days30  int
+	Days60  int
+	Days90  int
+	Over90  int
+	Total   int
+}
+
+// add puts the balance of b in the right bucket for the day asOf.
+func (row *AgingRow) add(b *Bill, asOf time.Time) {
+	amt := b.Balance()
+	days := 0
+	if !b.DueOn.IsZero() {
+		days = int(asOf.Sub(b.DueOn).Hours() / 24)
+	}
+
+	switch {
+	case days <= 0:
+		row.Current += amt
+	case days <= 30:
+		row.Days30 += amt
+	case days <= 60:
+		row.Days60 += amt
+	case days <= 90:
+		row.Days90 += amt
+	default:
+		row.Over90 += amt
+	}
+	row.Total += amt
+}
+
+type agingRows []*AgingRow
+
+func (r agingRows) Len() int           { return len(r) }
+func (r agingRows) Less(i, j int) bool { return r[i].Name < r[j].Name }
+func (r agingRows) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+type AgingReport struct {
+	AsOf      time.Time
+	Companies []*AgingRow
+	Vendors   []*AgingRow
+	Totals    *AgingRow
+}
+
+// NewAgingReport groups the balances of bills by company and by vendor.
+// Bills must have their companies and vendors loaded.
+func NewAgingReport(bills []*Bill, asOf time.Time) *AgingReport {
+	companies := map[string]*AgingRow{}
+	vendors := map[string]*AgingRow{}
+	report := &AgingReport{
+		AsOf:   asOf,
+		Totals: &AgingRow{Name: "Total"},
+	}
+
+	for _, b := range bills {
+		if b.Balance() <= 0 {
+			continue
+		}
+
+		companyName := "(no company)"
+		if b.Company != nil {
+			companyName = b.Company.Name
+		}
+
+		companyID := ""
+		if b.CompanyKey != nil {
+			companyID = b.CompanyKey.Encode()
+		}
+
+		row, ok := companies[companyID]
+		if !ok {
+			row = &AgingRow{Name: companyName}
+			companies[companyID] = row
+			report.Companies = append(report.Companies, row)
+		}
+		row.add(b, asOf)
+
+		vendorName := "(no vendor)"
+		if b.Vendor != nil {
+			vendorName = b.Vendor.Name
+		}
+
+		vendorID := companyID + "/" + b.VendorID()
+		row, ok = vendors[vendorID]
+		if !ok {
+			row = &AgingRow{Name: vendorName + " - " + companyName}
+			vendors[vendorID] = row
+			report.Vendors = append(report.Vendors, row)
+		}
+		row.add(b, asOf)
+
+		report.Totals.add(b, asOf)
+	}
+
+	sort.Sort(agingRows(report.Companies))
+	sort.Sort(agingRows(report.Vendors))
+
+	return report
+}
+
+// GetUnpaidBills returns every bill that has not been paid in full.
+func (ctx *Context) GetUnpaidBills() ([]*Bill, error) {
+	var bills []*Bill
+	q := datastore.NewQuery("Bill").Filter("Paid =", false)
+	keys, err := q.GetAll(ctx.c, &bills)
+	if err != nil {
+		return bills, err
+	}
+
+	unpaid := make([]*Bill, 0, len(bills))
+	for idx, k := range keys {
+		if bills[idx].Deleted {
+			continue
+		}
+		bills[idx].ID = k.IntID()
+		bills[idx].Key = k
+		unpaid = append(unpaid, bills[idx])
+	}
+
+	return unpaid, nil
+}
+
+func (ctx *Context) GetAgingReport() (*AgingReport, error) {
+	bills, err := ctx.GetUnpaidBills()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.LoadBillCompanies(bills)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.LoadBillVendors(bills)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAgingReport(bills, today()), nil
+}
+
+func handleAdminAging(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	report, err := ctx.GetAgingReport()
+	if err != nil {
+		return err
+	}
+
+	return ctx.renderAdmin(agingTmpl, report)
+}
+
+func handleAdminAgingCSV(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	report, err := ctx.GetAgingReport()
+	if err != nil {
+		return err
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/csv")
+	hdr.Set("Content-Disposition", "attachment; filename=aging-"+report.AsOf.Format(formDateLayout)+".csv")
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"Group", "Name", "Current", "1-30", "31-60", "61-90", "90+", "Total"})
+
+	write := func(group string, row *AgingRow) {
+		cw.Write([]string{
+			group,
+			row.Name,
+			tmplMoney(row.Current),
+			tmplMoney(row.Days30),
+			tmplMoney(row.Days60),
+			tmplMoney(row.Days90),
+			tmplMoney(row.Over90),
+			tmplMoney(row.Total),
+		})
+	}
+
+	for _, row := range report.Companies {
+		write("Company", row)
+	}
+	for _, row := range report.Vendors {
+		write("Vendor", row)
+	}
+	write("Total", report.Totals)
+
+	cw.Flush()
+	return cw.Error()
+}
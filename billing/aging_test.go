@@ -0,0 +1,51 @@
+package billing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAgingBuckets(t *testing.T) {
+	asOf := time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		bill    Bill
+		current int
+		days30  int
+		days60  int
+		days90  int
+		over90  int
+	}{
+		{"no due date", Bill{Amt: 100}, 100, 0, 0, 0, 0},
+		{"due later", Bill{Amt: 100, DueOn: asOf.AddDate(0, 0, 5)}, 100, 0, 0, 0, 0},
+		{"due today", Bill{Amt: 100, DueOn: asOf}, 100, 0, 0, 0, 0},
+		{"1 day late", Bill{Amt: 100, DueOn: asOf.AddDate(0, 0, -1)}, 0, 100, 0, 0, 0},
+		{"30 days late", Bill{Amt: 100, DueOn: asOf.AddDate(0, 0, -30)}, 0, 100, 0, 0, 0},
+		{"31 days late", Bill{Amt: 100, DueOn: asOf.AddDate(0, 0, -31)}, 0, 0, 100, 0, 0},
+		{"60 days late", Bill{Amt: 100, DueOn: asOf.AddDate(0, 0, -60)}, 0, 0, 100, 0, 0},
+		{"61 days late", Bill{Amt: 100, DueOn: asOf.AddDate(0, 0, -61)}, 0, 0, 0, 100, 0},
+		{"90 days late", Bill{Amt: 100, DueOn: asOf.AddDate(0, 0, -90)}, 0, 0, 0, 100, 0},
+		{"91 days late", Bill{Amt: 100, DueOn: asOf.AddDate(0, 0, -91)}, 0, 0, 0, 0, 100},
+		{"partly paid", Bill{Amt: 100, PaidAmt: 40, DueOn: asOf.AddDate(0, 0, -45)}, 0, 0, 60, 0, 0},
+		{"paid", Bill{Amt: 100, Paid: true, DueOn: asOf.AddDate(0, 0, -200)}, 0, 0, 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		row := &AgingRow{}
+		row.add(&tt.bill, asOf)
+
+		got := []int{row.Current, row.Days30, row.Days60, row.Days90, row.Over90}
+		want := []int{tt.current, tt.days30, tt.days60, tt.days90, tt.over90}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s: buckets %v, want %v", tt.name, got, want)
+				break
+			}
+		}
+
+		if row.Total != tt.bill.Balance() {
+			t.Errorf("%s: total %d, want %d", tt.name, row.Total, tt.bill.Balance())
+		}
+	}
+}
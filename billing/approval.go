@@ -0,0 +1,292 @@
+package billing
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Bill approval states.  A bill waits in pending until it has as many
+// approvals as its company's approval chain requires; a rejected bill goes
+// back to pending when it is resubmitted.
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// ApprovalRule requires Approvers different approvers for bills of MinAmt
+// cents or more.
+type ApprovalRule struct {
+	MinAmt    int
+	Approvers int
+}
+
+type approvalRules []ApprovalRule
+
+func (r approvalRules) Len() int           { return len(r) }
+func (r approvalRules) Less(i, j int) bool { return r[i].MinAmt < r[j].MinAmt }
+func (r approvalRules) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// BillApproval records one approver's sign off on a bill.
+type BillApproval struct {
+	By string
+	On time.Time
+}
+
+// RequiredApprovals returns how many approvers a bill of amt cents needs
+// under the company approval chain.  Without rules no approval is needed.
+func (c *Company) RequiredApprovals(amt int) int {
+	n := 0
+	for _, r := range c.ApprovalRules {
+		if amt >= r.MinAmt && r.Approvers > n {
+			n = r.Approvers
+		}
+	}
+	return n
+}
+
+// startApproval puts a newly posted bill at the start of the approval chain
+// of company c.
+func (b *Bill) startApproval(c *Company) {
+	b.ApprovalsRequired = c.RequiredApprovals(b.Amt)
+	b.Approvals = nil
+	b.Approval = ApprovalPending
+	if b.ApprovalsRequired == 0 {
+		b.Approval = ApprovalApproved
+	}
+}
+
+// ApprovalState returns the approval state of the bill.  Bills posted
+// before approvals existed count as approved.
+func (b *Bill) ApprovalState() string {
+	if b.Approval == "" {
+		return ApprovalApproved
+	}
+	return b.Approval
+}
+
+func (b *Bill) AwaitingApproval() bool {
+	return b.ApprovalState() == ApprovalPending
+}
+
+func (b *Bill) Approved() bool {
+	return b.ApprovalState() == ApprovalApproved
+}
+
+func (b *Bill) Rejected() bool {
+	return b.ApprovalState() == ApprovalRejected
+}
+
+func (b *Bill) ApprovedBy(by string) bool {
+	for _, a := range b.Approvals {
+		if a.By == by {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bill) ApprovalLabel() string {
+	switch b.ApprovalState() {
+	case ApprovalPending:
+		return fmt.Sprintf("Pending (%d of %d approvals)", len(b.Approvals), b.ApprovalsRequired)
+	case ApprovalRejected:
+		return "Rejected"
+	}
+
+	if b.ApprovalsRequired == 0 {
+		return "Not required"
+	}
+	return "Approved"
+}
+
+// approve adds by to the approvers of the bill and approves it once the
+// chain is complete.
+func (b *Bill) approve(by string, now time.Time) error {
+	if !b.AwaitingApproval() {
+		return BillStatusError("Bill is not waiting for approval")
+	}
+	if b.ApprovedBy(by) {
+		return BillStatusError("You have already approved this bill")
+	}
+
+	b.Approvals = append(b.Approvals, BillApproval{by, now})
+	if len(b.Approvals) >= b.ApprovalsRequired {
+		b.Approval = ApprovalApproved
+	}
+	return nil
+}
+
+func (b *Bill) reject(by, reason string, now time.Time) error {
+	if reason == "" {
+		return BillStatusError("You must give a reason to reject a bill")
+	}
+	if !b.AwaitingApproval() {
+		return BillStatusError("Bill is not waiting for approval")
+	}
+
+	b.Approval = ApprovalRejected
+	b.RejectedBy = by
+	b.RejectedOn = now
+	b.RejectionReason = reason
+	return nil
+}
+
+// resubmit sends a rejected bill back through the whole approval chain.
+func (b *Bill) resubmit() error {
+	if !b.Rejected() {
+		return BillStatusError("Only rejected bills can be resubmitted")
+	}
+
+	b.Approval = ApprovalPending
+	b.Approvals = nil
+	b.RejectedBy = ""
+	b.RejectedOn = time.Time{}
+	b.RejectionReason = ""
+	return nil
+}
+
+// GetCompanyPendingBills returns the bills of company c waiting for
+// approval, oldest first.
+func (ctx *Context) GetCompanyPendingBills(c *Company, p *Pager) ([]*Bill, error) {
+	bills := make([]*Bill, 0, 20)
+	q := datastore.NewQuery("Bill").Ancestor(c.Key).Filter("Approval =", ApprovalPending).Order("PostedOn")
+	keys, err := ctx.getPageWhere(q, p, &bills, notDeleted)
+	if err != nil {
+		return bills, err
+	}
+
+	for idx, k := range keys {
+		bills[idx].ID = k.IntID()
+		bills[idx].Key = k
+	}
+
+	return bills, nil
+}
+
+// SetApprovalRules replaces the approval chain of company c.  Bills already
+// posted keep the number of approvals they were posted with.
+func (ctx *Context) SetApprovalRules(c *Company, rules []ApprovalRule) error {
+	return datastore.RunInTransaction(ctx.c, func(tc appengine.Context) error {
+		company := new(Company)
+		err := datastore.Get(tc, c.Key, company)
+		if err != nil {
+			return err
+		}
+
+		before := *company
+		company.ApprovalRules = rules
+		_, err = datastore.Put(tc, c.Key, company)
+		if err != nil {
+			return err
+		}
+
+		return ctx.recordAudit(tc, AuditUpdate, c.Key, &before, company)
+	}, nil)
+}
+
+func validateApprovalRules(rules []ApprovalRule) []string {
+	errs := []string{}
+	seen := map[int]bool{}
+
+	for idx, r := range rules {
+		if r.MinAmt < 0 {
+			errs = append(errs, fmt.Sprintf("Rule %d amount cannot be negative", idx+1))
+		}
+		if r.Approvers <= 0 {
+			errs = append(errs, fmt.Sprintf("Rule %d must require at least one approver", idx+1))
+		}
+		if seen[r.MinAmt] {
+			errs = append(errs, fmt.Sprintf("Rule %d repeats the amount of an earlier rule", idx+1))
+		}
+		seen[r.MinAmt] = true
+	}
+
+	return errs
+}
+
+type ApprovalsPage struct {
+	Bills []*Bill
+	Pager *Pager
+	Me    string
+}
+
+func handleApprovals(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	company := ctx.userSession.Company
+	p := NewPager(r.URL.Query(), "", 20)
+	bills, err := ctx.GetCompanyPendingBills(company, p)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.LoadBillVendors(bills)
+	if err != nil {
+		return err
+	}
+
+	ctx.SetTitle("Bills Waiting for Approval")
+
+	return ctx.Render(approvalsTmpl, ApprovalsPage{bills, p, ctx.user.String()})
+}
+
+// approvalRuleRows is how many rules the approval chain form shows.
+const approvalRuleRows = 4
+
+type ApprovalRulesForm struct {
+	Company        *Company
+	Rules          []ApprovalRule
+	ValidationErrs []string
+}
+
+func renderApprovalRulesForm(ctx *Context, c *Company, rules []ApprovalRule, errs []string) error {
+	rows := make([]ApprovalRule, approvalRuleRows)
+	copy(rows, rules)
+	return ctx.renderAdmin(companyApprovalsTmpl, ApprovalRulesForm{c, rows, errs})
+}
+
+func handleAdminCompanyApprovals(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	c, err := ctx.GetCompanyByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	if r.Method != "POST" {
+		return renderApprovalRulesForm(ctx, c, c.ApprovalRules, []string{})
+	}
+
+	rules := []ApprovalRule{}
+	for idx := 0; idx < approvalRuleRows; idx++ {
+		minAmt := fmt.Sprintf("min_amt_%d", idx)
+		approvers := fmt.Sprintf("approvers_%d", idx)
+		if r.FormValue(minAmt) == "" && r.FormValue(approvers) == "" {
+			continue
+		}
+
+		n, _ := strconv.Atoi(r.FormValue(approvers))
+		rules = append(rules, ApprovalRule{
+			MinAmt:    getFormFieldMoney(r.Form, minAmt),
+			Approvers: n,
+		})
+	}
+
+	errs := validateApprovalRules(rules)
+	if len(errs) > 0 {
+		return renderApprovalRulesForm(ctx, c, rules, errs)
+	}
+
+	sort.Sort(approvalRules(rules))
+
+	err = ctx.SetApprovalRules(c, rules)
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Approval chain saved")
+	return ctx.Redirect("/admin/company/view?id=" + c.ID)
+}
@@ -0,0 +1,270 @@
+package billing
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Audit actions.
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+)
+
+var auditKinds = []string{"Company", "User", "Vendor", "Bill"}
+
+// AuditChange holds the value of one field before and after a change.
+// Values are empty for fields that did not exist on one side.
+type AuditChange struct {
+	Field  string
+	Before string `datastore:",noindex"`
+	After  string `datastore:",noindex"`
+}
+
+// AuditEvent records a create, update, delete, restore or purge of a
+// Company, User, Vendor or Bill.  Events are only ever added: each is
+// stored as a child of the changed entity and written in the same
+// transaction as the change, so the log cannot miss a change or record one
+// that did not happen.
+type AuditEvent struct {
+	Key        *datastore.Key `datastore:"-"`
+	EntityKind string
+	EntityKey  *datastore.Key
+	Action     string
+	Actor      string
+	On         time.Time
+	Changes    []AuditChange
+}
+
+func (ev *AuditEvent) EntityID() string {
+	if ev.EntityKey == nil {
+		return ""
+	}
+	if ev.EntityKey.StringID() != "" {
+		return ev.EntityKey.StringID()
+	}
+	return fmt.Sprint(ev.EntityKey.IntID())
+}
+
+func (ev *AuditEvent) EncodedEntityKey() string {
+	if ev.EntityKey == nil {
+		return ""
+	}
+	return ev.EntityKey.Encode()
+}
+
+// auditValue formats a field value for an AuditChange.
+func auditValue(v reflect.Value) string {
+	switch val := v.Interface().(type) {
+	case *datastore.Key:
+		if val == nil {
+			return ""
+		}
+		return val.Encode()
+	case time.Time:
+		if val.IsZero() {
+			return ""
+		}
+		return val.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// auditFields returns the stored fields of the struct pointed to by src,
+// formatted with auditValue.  src may be nil.
+func auditFields(src interface{}) (map[string]string, []string) {
+	values := map[string]string{}
+	names := []string{}
+	if src == nil {
+		return values, names
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(src))
+	if !v.IsValid() {
+		return values, names
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("datastore") == "-" {
+			continue
+		}
+		names = append(names, f.Name)
+		values[f.Name] = auditValue(v.Field(i))
+	}
+
+	return values, names
+}
+
+// auditChanges lists the fields that differ between before and after,
+// either of which may be nil.
+func auditChanges(before, after interface{}) []AuditChange {
+	old, oldNames := auditFields(before)
+	cur, curNames := auditFields(after)
+
+	names := curNames
+	if len(names) == 0 {
+		names = oldNames
+	}
+
+	changes := []AuditChange{}
+	for _, name := range names {
+		if old[name] != cur[name] {
+			changes = append(changes, AuditChange{name, old[name], cur[name]})
+		}
+	}
+	return changes
+}
+
+// recordAudit adds an AuditEvent for the change of the entity at key from
+// before to after.  It must be called with the transaction context c of the
+// change.  Updates that change nothing are not recorded.
+func (ctx *Context) recordAudit(c appengine.Context, action string, key *datastore.Key, before, after interface{}) error {
+	changes := auditChanges(before, after)
+	if action == AuditUpdate && len(changes) == 0 {
+		return nil
+	}
+
+	ev := AuditEvent{
+		EntityKind: key.Kind(),
+		EntityKey:  key,
+		Action:     action,
+		Actor:      ctx.user.String(),
+		On:         time.Now(),
+		Changes:    changes,
+	}
+	_, err := datastore.Put(c, datastore.NewIncompleteKey(c, "AuditEvent", key), &ev)
+	return err
+}
+
+// putAudited stores src at key and records the change from before in the
+// same transaction.  before is nil when src is a new entity.  It returns the
+// key src was stored under.
+func (ctx *Context) putAudited(key *datastore.Key, before, src interface{}) (*datastore.Key, error) {
+	action := AuditUpdate
+	if before == nil {
+		action = AuditCreate
+	}
+
+	var stored *datastore.Key
+	err := datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		k, err := datastore.Put(c, key, src)
+		if err != nil {
+			return err
+		}
+
+		stored = k
+		return ctx.recordAudit(c, action, k, before, src)
+	}, nil)
+
+	return stored, err
+}
+
+// AuditFilter narrows the audit log search.  Entity limits the search to one
+// entity, whose events are its children, so Kind is not needed with it.
+type AuditFilter struct {
+	Entity string
+	Kind   string
+	Actor  string
+	From   time.Time
+	To     time.Time
+
+	entityKey *datastore.Key
+}
+
+func NewAuditFilter(v url.Values) *AuditFilter {
+	f := &AuditFilter{
+		Entity: v.Get("entity"),
+		Kind:   v.Get("kind"),
+		Actor:  strings.TrimSpace(v.Get("actor")),
+		From:   getFormFieldDate(v, "from"),
+		To:     getFormFieldDate(v, "to"),
+	}
+
+	if f.Entity != "" {
+		k, err := datastore.DecodeKey(f.Entity)
+		if err != nil {
+			f.Entity = ""
+		} else {
+			f.entityKey = k
+		}
+	}
+
+	validKind := false
+	for _, k := range auditKinds {
+		if f.Kind == k {
+			validKind = true
+		}
+	}
+	if !validKind || f.entityKey != nil {
+		f.Kind = ""
+	}
+
+	return f
+}
+
+func (f *AuditFilter) Kinds() []string {
+	return auditKinds
+}
+
+func (f *AuditFilter) query() *datastore.Query {
+	q := datastore.NewQuery("AuditEvent")
+	if f.entityKey != nil {
+		q = q.Ancestor(f.entityKey)
+	}
+	if f.Kind != "" {
+		q = q.Filter("EntityKind =", f.Kind)
+	}
+	if f.Actor != "" {
+		q = q.Filter("Actor =", f.Actor)
+	}
+	if !f.From.IsZero() {
+		q = q.Filter("On >=", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Filter("On <", f.To.AddDate(0, 0, 1))
+	}
+	return q.Order("-On")
+}
+
+func (ctx *Context) SearchAuditEvents(f *AuditFilter, p *Pager) ([]*AuditEvent, error) {
+	events := make([]*AuditEvent, 0, 20)
+	keys, err := ctx.getPage(f.query(), p, &events)
+	if err != nil {
+		return events, err
+	}
+
+	for idx, k := range keys {
+		events[idx].Key = k
+	}
+
+	return events, nil
+}
+
+type AuditPage struct {
+	Events []*AuditEvent
+	Filter *AuditFilter
+	Pager  *Pager
+}
+
+func handleAdminAudit(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	f := NewAuditFilter(r.URL.Query())
+	p := NewPager(r.URL.Query(), "", 50)
+	events, err := ctx.SearchAuditEvents(f, p)
+	if err != nil {
+		return err
+	}
+
+	return ctx.renderAdmin(auditTmpl, AuditPage{events, f, p})
+}
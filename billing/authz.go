@@ -0,0 +1,89 @@
+package billing
+
+import (
+	"appengine"
+	"appengine/datastore"
+)
+
+// canAccessBill reports whether the current user may see b.  Admins can see
+// every bill; everyone else only the bills of their own company.
+func (ctx *Context) canAccessBill(b *Bill) bool {
+	if ctx.admin {
+		return true
+	}
+
+	if ctx.userSession == nil || ctx.userSession.Company == nil || ctx.userSession.Company.Key == nil {
+		return false
+	}
+
+	return b.CompanyKey != nil && b.CompanyKey.Equal(ctx.userSession.Company.Key)
+}
+
+// GetAuthorizedBill loads the bill with the encoded key id.  A bill that
+// does not exist, cannot be decoded, is in the trash or belongs to another
+// company is reported as datastore.ErrNoSuchEntity so that it is served as
+// a 404 and does not reveal that the bill exists.
+func (ctx *Context) GetAuthorizedBill(id string) (*Bill, error) {
+	b, err := ctx.GetBillByID(id)
+	if b.Key == nil {
+		return b, datastore.ErrNoSuchEntity
+	}
+
+	if err != nil {
+		return b, err
+	}
+
+	if b.Deleted || !ctx.canAccessBill(b) {
+		return b, datastore.ErrNoSuchEntity
+	}
+
+	return b, nil
+}
+
+// GetBlobBill returns the bill a blob belongs to, either as the bill file or
+// as the proof of one of its payments.
+func (ctx *Context) GetBlobBill(blobKey appengine.BlobKey) (*Bill, error) {
+	var bills []*Bill
+	keys, err := datastore.NewQuery("Bill").Filter("BlobKey =", blobKey).Limit(1).GetAll(ctx.c, &bills)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) > 0 {
+		bills[0].ID = keys[0].IntID()
+		bills[0].Key = keys[0]
+		return bills[0], nil
+	}
+
+	keys, err = datastore.NewQuery("Payment").Filter("ProofBlobKey =", blobKey).KeysOnly().Limit(1).GetAll(ctx.c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, datastore.ErrNoSuchEntity
+	}
+
+	b := new(Bill)
+	billKey := keys[0].Parent()
+	err = datastore.Get(ctx.c, billKey, b)
+	b.ID = billKey.IntID()
+	b.Key = billKey
+
+	return b, err
+}
+
+// GetAuthorizedBlobBill is GetBlobBill limited to bills the current user may
+// see.
+func (ctx *Context) GetAuthorizedBlobBill(blobKey appengine.BlobKey) (*Bill, error) {
+	b, err := ctx.GetBlobBill(blobKey)
+	if err != nil {
+		return b, err
+	}
+
+	if b.Deleted || !ctx.canAccessBill(b) {
+		return b, datastore.ErrNoSuchEntity
+	}
+
+	return b, nil
+}
@@ -0,0 +1,188 @@
+package billing
+
+import (
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Bank change states.
+const (
+	BankChangePending   = "pending"
+	BankChangeConfirmed = "confirmed"
+	BankChangeRejected  = "rejected"
+)
+
+// BankChange records a change to the bank details of a vendor.  Changes to
+// an existing vendor do not take effect until a second user confirms them,
+// and payments to the vendor are held until then.  Changes are stored as
+// children of the vendor and are never deleted, so they form its history.
+type BankChange struct {
+	Key         *datastore.Key `datastore:"-"`
+	State       string
+	Before      BankAccount
+	After       BankAccount
+	RequestedBy string
+	RequestedOn time.Time
+	ReviewedBy  string
+	ReviewedOn  time.Time
+	Reason      string
+}
+
+func (bc *BankChange) EncodedKey() string {
+	return bc.Key.Encode()
+}
+
+func (bc *BankChange) Pending() bool {
+	return bc.State == BankChangePending
+}
+
+// paymentHold returns a BillStatusError if payments to the vendor at key
+// are held for a bank change, or nil.  It may be run inside a transaction.
+func paymentHold(c appengine.Context, key *datastore.Key) error {
+	if key == nil {
+		return nil
+	}
+
+	v := new(Vendor)
+	err := datastore.Get(c, key, v)
+	if err != nil {
+		return err
+	}
+
+	if v.BankChangePending {
+		return BillStatusError("Payments to " + v.Name + " are on hold until the change to its bank details is confirmed")
+	}
+
+	return nil
+}
+
+// requestBankChange holds the change of the bank details of v to bank for
+// confirmation.  It must be called in the transaction that saves v.
+func (ctx *Context) requestBankChange(c appengine.Context, key *datastore.Key, v *Vendor, bank BankAccount) error {
+	if v.BankChangePending {
+		return InUseError("A change to the bank details of this vendor is waiting to be confirmed. Confirm or reject it first.")
+	}
+
+	bc := BankChange{
+		State:       BankChangePending,
+		Before:      v.Bank,
+		After:       bank,
+		RequestedBy: ctx.user.String(),
+		RequestedOn: time.Now(),
+	}
+	_, err := datastore.Put(c, datastore.NewIncompleteKey(c, "BankChange", key), &bc)
+	if err != nil {
+		return err
+	}
+
+	v.BankChangePending = true
+	return nil
+}
+
+// ReviewBankChange confirms or rejects the pending bank change at key.  A
+// change can only be confirmed by someone other than who requested it; the
+// requester may still reject it to withdraw it.
+func (ctx *Context) ReviewBankChange(key *datastore.Key, confirm bool, reason string) error {
+	if key.Kind() != "BankChange" || key.Parent() == nil {
+		return datastore.ErrNoSuchEntity
+	}
+
+	by := ctx.user.String()
+	vendorKey := key.Parent()
+
+	return datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		bc := new(BankChange)
+		err := datastore.Get(c, key, bc)
+		if err != nil {
+			return err
+		}
+
+		if !bc.Pending() {
+			return BillStatusError("This bank change has already been reviewed")
+		}
+
+		if confirm && bc.RequestedBy == by {
+			return BillStatusError("You requested this bank change. Another user must confirm it")
+		}
+
+		v := new(Vendor)
+		err = datastore.Get(c, vendorKey, v)
+		if err != nil {
+			return err
+		}
+
+		before := *v
+		if confirm {
+			bc.State = BankChangeConfirmed
+			v.Bank = bc.After
+		} else {
+			bc.State = BankChangeRejected
+		}
+		bc.ReviewedBy = by
+		bc.ReviewedOn = time.Now()
+		bc.Reason = reason
+		v.BankChangePending = false
+
+		_, err = datastore.Put(c, key, bc)
+		if err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(c, vendorKey, v)
+		if err != nil {
+			return err
+		}
+
+		return ctx.recordAudit(c, AuditUpdate, vendorKey, &before, v)
+	}, nil)
+}
+
+// GetBankChanges returns the bank detail changes of v, newest first.
+func (ctx *Context) GetBankChanges(v *Vendor) ([]*BankChange, error) {
+	changes := make([]*BankChange, 0, 10)
+	q := datastore.NewQuery("BankChange").Ancestor(v.Key).Order("-RequestedOn")
+	keys, err := q.GetAll(ctx.c, &changes)
+	if err != nil {
+		return changes, err
+	}
+
+	for idx, k := range keys {
+		changes[idx].Key = k
+	}
+
+	return changes, nil
+}
+
+func handleAdminBankChange(confirm bool) myHandler {
+	return func(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+		key, err := datastore.DecodeKey(r.FormValue("id"))
+		if err != nil || key.Kind() != "BankChange" || key.Parent() == nil {
+			return datastore.ErrNoSuchEntity
+		}
+
+		vendorURL := "/admin/vendor/view?id=" + key.Parent().Encode()
+		if r.Method != "POST" {
+			return ctx.Redirect(vendorURL)
+		}
+
+		err = ctx.ReviewBankChange(key, confirm, r.FormValue("reason"))
+		if serr, ok := err.(BillStatusError); ok {
+			ctx.Flash("%s", serr.Error())
+			return ctx.Redirect(vendorURL)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if confirm {
+			ctx.Flash("Bank details change confirmed")
+		} else {
+			ctx.Flash("Bank details change rejected")
+		}
+		return ctx.Redirect(vendorURL)
+	}
+}
@@ -0,0 +1,95 @@
+package billing
+
+import (
+	"math/big"
+	"regexp"
+	"strconv"
+)
+
+var (
+	usRouting  = regexp.MustCompile(`^[0-9]{9}$`)
+	usAccount  = regexp.MustCompile(`^[0-9]{4,17}$`)
+	ibanFormat = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+	bicFormat  = regexp.MustCompile(`^[A-Z]{4}[A-Z]{2}[A-Z0-9]{2}([A-Z0-9]{3})?$`)
+)
+
+// ibanLengths is the length of an IBAN in each country that uses them, from
+// the SWIFT IBAN registry.
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16,
+	"BG": 22, "BH": 22, "BR": 29, "BY": 28, "CH": 21, "CR": 22, "CY": 28,
+	"CZ": 24, "DE": 22, "DK": 18, "DO": 28, "EE": 20, "EG": 29, "ES": 24,
+	"FI": 18, "FO": 18, "FR": 27, "GB": 22, "GE": 22, "GI": 23, "GL": 18,
+	"GR": 27, "GT": 28, "HR": 21, "HU": 28, "IE": 22, "IL": 23, "IQ": 23,
+	"IS": 26, "IT": 27, "JO": 30, "KW": 30, "KZ": 20, "LB": 28, "LC": 32,
+	"LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MD": 24, "ME": 22,
+	"MK": 19, "MR": 27, "MT": 31, "MU": 30, "NL": 18, "NO": 15, "PK": 24,
+	"PL": 28, "PS": 29, "PT": 25, "QA": 29, "RO": 24, "RS": 22, "SA": 24,
+	"SC": 31, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "ST": 25, "SV": 28,
+	"TL": 23, "TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+}
+
+// validABARouting reports whether s is a nine digit ABA routing number with
+// a correct check digit.  The digits are weighted 3, 7, 1 in turn and must
+// sum to a multiple of ten.
+func validABARouting(s string) bool {
+	if !usRouting.MatchString(s) {
+		return false
+	}
+
+	weights := []int{3, 7, 1}
+	sum := 0
+	for i, c := range s {
+		sum += int(c-'0') * weights[i%3]
+	}
+
+	return sum != 0 && sum%10 == 0
+}
+
+// validUSAccount reports whether s looks like a US bank account number.
+// Account numbers have no check digit, so only the format can be checked.
+func validUSAccount(s string) bool {
+	return usAccount.MatchString(s)
+}
+
+// ibanProblem returns what is wrong with the compacted IBAN s, or "" if it
+// has the length of its country and passes the ISO 13616 mod 97 check.
+func ibanProblem(s string) string {
+	if !ibanFormat.MatchString(s) {
+		return "IBAN must start with a country code and two check digits followed by letters and digits"
+	}
+
+	length, ok := ibanLengths[s[:2]]
+	if !ok {
+		return "IBAN country " + s[:2] + " does not use IBANs"
+	}
+
+	if len(s) != length {
+		return "IBAN for " + s[:2] + " must be " + strconv.Itoa(length) + " characters"
+	}
+
+	// Move the country code and check digits to the end and replace each
+	// letter with two digits, A = 10 to Z = 35.
+	digits := make([]byte, 0, len(s)*2)
+	for _, c := range s[4:] + s[:4] {
+		if c >= 'A' && c <= 'Z' {
+			digits = append(digits, strconv.Itoa(int(c-'A'+10))...)
+		} else {
+			digits = append(digits, byte(c))
+		}
+	}
+
+	n, ok := new(big.Int).SetString(string(digits), 10)
+	if !ok || new(big.Int).Mod(n, big.NewInt(97)).Int64() != 1 {
+		return "IBAN check digits are not correct"
+	}
+
+	return ""
+}
+
+// validBIC reports whether s is a BIC/SWIFT code: a four letter bank code,
+// a two letter country code, a two character location code and an optional
+// three character branch code.
+func validBIC(s string) bool {
+	return bicFormat.MatchString(s)
+}
@@ -0,0 +1,93 @@
+package billing
+
+import "testing"
+
+func TestValidABARouting(t *testing.T) {
+	tests := []struct {
+		routing string
+		valid   bool
+	}{
+		{"011000015", true},
+		{"021000021", true},
+		{"121000358", true},
+		{"011000016", false},
+		{"021000012", false},
+		{"000000000", false},
+		{"01100001", false},
+		{"0110000150", false},
+		{"01100001A", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := validABARouting(tt.routing); got != tt.valid {
+			t.Errorf("validABARouting(%q) = %v, want %v", tt.routing, got, tt.valid)
+		}
+	}
+}
+
+func TestValidUSAccount(t *testing.T) {
+	tests := []struct {
+		account string
+		valid   bool
+	}{
+		{"1234", true},
+		{"12345678901234567", true},
+		{"123", false},
+		{"123456789012345678", false},
+		{"1234-5678", false},
+	}
+
+	for _, tt := range tests {
+		if got := validUSAccount(tt.account); got != tt.valid {
+			t.Errorf("validUSAccount(%q) = %v, want %v", tt.account, got, tt.valid)
+		}
+	}
+}
+
+func TestIBANProblem(t *testing.T) {
+	tests := []struct {
+		iban  string
+		valid bool
+	}{
+		{"GB82WEST12345698765432", true},
+		{"DE89370400440532013000", true},
+		{"FR1420041010050500013M02606", true},
+		{"NL91ABNA0417164300", true},
+		{"GB82WEST12345698765431", false},
+		{"GB28WEST12345698765432", false},
+		{"DE89370400440532013001", false},
+		{"GB82WEST1234569876543", false},
+		{"XX82WEST12345698765432", false},
+		{"gb82west12345698765432", false},
+		{"GB82", false},
+	}
+
+	for _, tt := range tests {
+		problem := ibanProblem(tt.iban)
+		if (problem == "") != tt.valid {
+			t.Errorf("ibanProblem(%q) = %q, want valid %v", tt.iban, problem, tt.valid)
+		}
+	}
+}
+
+func TestValidBIC(t *testing.T) {
+	tests := []struct {
+		bic   string
+		valid bool
+	}{
+		{"DEUTDEFF", true},
+		{"DEUTDEFF500", true},
+		{"NEDSZAJJXXX", true},
+		{"DEUTDE", false},
+		{"DEUTDEFF50", false},
+		{"deutdeff", false},
+		{"1EUTDEFF", false},
+	}
+
+	for _, tt := range tests {
+		if got := validBIC(tt.bic); got != tt.valid {
+			t.Errorf("validBIC(%q) = %v, want %v", tt.bic, got, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package billing
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// achCompanyID is the ten character identifier the bank assigns a company
+// that originates ACH files, usually "1" followed by its EIN.
+var achCompanyID = regexp.MustCompile(`^[0-9A-Z]{10}$`)
+
+// ValidateBanking returns a list of problems with the bank account the
+// company pays from.  A US account is needed for ACH payments; an IBAN and
+// BIC may be given as well for international credit transfers.
+func (c *Company) ValidateBanking() []string {
+	errs := c.Bank.validate()
+
+	if c.Bank.IBAN != "" && c.Bank.BIC == "" && c.Bank.RoutingNumber == "" {
+		errs = append(errs, "A BIC is needed with the IBAN")
+	}
+
+	if c.ACHCompanyID != "" && !achCompanyID.MatchString(c.ACHCompanyID) {
+		errs = append(errs, "ACH company ID must be 10 letters and digits, usually 1 followed by the EIN")
+	}
+
+	if c.Currency != "" && !centsCurrency(c.Currency) {
+		errs = append(errs, "Currency must be a three letter ISO 4217 code of a currency with cents, such as EUR")
+	}
+
+	errs = append(errs, c.PositivePay.validate()...)
+
+	return errs
+}
+
+// CanOriginateACH reports whether the company has the bank details needed
+// to generate ACH files.
+func (c *Company) CanOriginateACH() bool {
+	return c.Bank.RoutingNumber != "" && c.Bank.AccountNumber != "" && c.ACHCompanyID != ""
+}
+
+// BillCurrency returns the currency the company's bills are in and paid
+// from, US dollars unless the company has set another.
+func (c *Company) BillCurrency() string {
+	if c.Currency == "" {
+		return "USD"
+	}
+	return c.Currency
+}
+
+// CanOriginateTransfers reports whether the company has the bank details
+// needed to generate ISO 20022 credit transfers.
+func (c *Company) CanOriginateTransfers() bool {
+	return canTransferFrom(c.Bank)
+}
+
+// SetCompanyBanking replaces the bank account company c pays from and sets
+// the number of the next check written on it to nextCheck.  Check numbers
+// only move forward, so checks already written are never numbered again.
+func (ctx *Context) SetCompanyBanking(c *Company, nextCheck int) error {
+	return datastore.RunInTransaction(ctx.c, func(tc appengine.Context) error {
+		company := new(Company)
+		err := datastore.Get(tc, c.Key, company)
+		if err != nil {
+			return err
+		}
+
+		before := *company
+		company.Bank = c.Bank
+		company.ACHCompanyID = c.ACHCompanyID
+		company.PositivePay = c.PositivePay
+		company.Currency = c.Currency
+
+		if next := company.NextCheck(); nextCheck != next {
+			if nextCheck < next || nextCheck > maxCheckNum {
+				return BillStatusError(fmt.Sprintf("Next check number must be between %d and %d", next, maxCheckNum))
+			}
+			company.setNextCheck(nextCheck)
+		}
+
+		_, err = datastore.Put(tc, c.Key, company)
+		if err != nil {
+			return err
+		}
+
+		return ctx.recordAudit(tc, AuditUpdate, c.Key, &before, company)
+	}, nil)
+}
+
+type BankingForm struct {
+	Company            *Company
+	NextCheck          int
+	ValidationErrs     []string
+	AccountTypes       []AccountType
+	PositivePayFormats []PositivePayFormat
+	PositivePayDates   []PositivePayFormat
+}
+
+func handleAdminCompanyBanking(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	c, err := ctx.GetCompanyByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	if r.Method != "POST" {
+		c.PositivePay = c.PositivePayConfig()
+		return ctx.renderAdmin(companyBankingTmpl, BankingForm{c, c.NextCheck(), []string{}, accountTypes, positivePayFormats, positivePayDates})
+	}
+
+	c.Bank = BankAccount{
+		BankName:      strings.TrimSpace(r.FormValue("bank_name")),
+		AccountName:   strings.TrimSpace(r.FormValue("account_name")),
+		AccountType:   r.FormValue("account_type"),
+		RoutingNumber: compact(r.FormValue("routing_number")),
+		AccountNumber: compact(r.FormValue("account_number")),
+		IBAN:          compact(r.FormValue("iban")),
+		BIC:           compact(r.FormValue("bic")),
+	}
+	c.ACHCompanyID = compact(r.FormValue("ach_company_id"))
+	c.Currency = compact(r.FormValue("currency"))
+	nextCheck := getFormFieldInt(r.Form, "next_check_num")
+	c.PositivePay = PositivePaySettings{
+		Format:     r.FormValue("positive_pay_format"),
+		DateLayout: r.FormValue("positive_pay_date"),
+		Header:     r.FormValue("positive_pay_header") != "",
+	}
+
+	errs := c.ValidateBanking()
+	if len(errs) > 0 {
+		return ctx.renderAdmin(companyBankingTmpl, BankingForm{c, nextCheck, errs, accountTypes, positivePayFormats, positivePayDates})
+	}
+
+	err = ctx.SetCompanyBanking(c, nextCheck)
+	if serr, ok := err.(BillStatusError); ok {
+		errs = append(errs, serr.Error())
+		return ctx.renderAdmin(companyBankingTmpl, BankingForm{c, nextCheck, errs, accountTypes, positivePayFormats, positivePayDates})
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Bank account saved")
+	return ctx.Redirect("/admin/company/view?id=" + c.ID)
+}
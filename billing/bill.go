@@ -15,18 +15,122 @@ type Bill struct {
 	VendorKey  *datastore.Key
 	BlobKey    appengine.BlobKey
 	Amt        int
-	Paid       bool
-	Reconciled bool
+
+	// InvoiceNum and Date are the vendor's invoice number and invoice date.
+	InvoiceNum string
+	Date       time.Time
+	DueOn      time.Time
+
+	// Terms is the vendor payment terms code in effect when the bill was
+	// created.  DiscountAmt is taken off the bill if it is paid in full by
+	// DiscountBy; DiscountTaken is set once that happens.
+	Terms         string
+	DiscountBy    time.Time
+	DiscountAmt   int
+	DiscountTaken int
+
+	// PaidOn is when the bill was marked paid, and SettledOn the payment
+	// date of the payment that paid it off, which may be earlier.
+	Paid         bool
+	PaidAmt      int
+	PaidOn       time.Time
+	PaidBy       string
+	SettledOn    time.Time
+	Reconciled   bool
+	ReconciledOn time.Time
+	ReconciledBy string
+	Installments []Installment
+
+	// Approval is the approval state of the bill.  ApprovalsRequired is set
+	// from the company approval chain when the bill is posted.
+	Approval          string
+	ApprovalsRequired int
+	Approvals         []BillApproval
+	RejectedBy        string
+	RejectedOn        time.Time
+	RejectionReason   string
+
+	// BatchKey is the payment batch the bill is being paid in.  It is
+	// cleared once the batch is confirmed or cancelled.
+	BatchKey *datastore.Key
+
+	// A deleted bill stays in the trash until it is restored or purged.
+	Deleted   bool
+	DeletedOn time.Time
+	DeletedBy string
 
 	Company *Company `datastore:"-"`
 	Vendor  *Vendor  `datastore:"-"`
 }
 
-func (ctx *Context) GetAllBills() ([]*Bill, error) {
+type billsByDue []*Bill
+
+func (b billsByDue) Len() int           { return len(b) }
+func (b billsByDue) Less(i, j int) bool { return b[i].DueOn.Before(b[j].DueOn) }
+func (b billsByDue) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func (ctx *Context) GetBillByID(id string) (*Bill, error) {
+	b := new(Bill)
+	k, err := datastore.DecodeKey(id)
+
+	b.Key = k
+
+	if err != nil {
+		return b, err
+	}
+
+	err = datastore.Get(ctx.c, k, b)
+	b.ID = k.IntID()
+
+	return b, err
+}
+
+func (b *Bill) VendorID() string {
+	if b.VendorKey == nil {
+		return ""
+	}
+	return b.VendorKey.Encode()
+}
+
+// today returns midnight at the start of the current day in UTC.
+func today() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour)
+}
+
+// ValidateInvoice returns a list of problems with the invoice details of
+// the bill.
+func (b *Bill) ValidateInvoice() []string {
+	errs := []string{}
+
+	if b.InvoiceNum == "" {
+		errs = append(errs, "Invoice number must be valid")
+	}
+
+	if b.Date.IsZero() {
+		errs = append(errs, "Invoice date must be valid")
+	} else if b.Date.After(today()) {
+		errs = append(errs, "Invoice date cannot be in the future")
+	}
+
+	if !b.DueOn.IsZero() && !b.Date.IsZero() && b.DueOn.Before(b.Date) {
+		errs = append(errs, "Due date cannot be before the invoice date")
+	}
+
+	return errs
+}
+
+// InvoiceExists reports whether the vendor already has a bill with the
+// given invoice number.  Bills in the trash are not counted.
+func (ctx *Context) InvoiceExists(vendorKey *datastore.Key, invoiceNum string) (bool, error) {
+	q := datastore.NewQuery("Bill").Filter("VendorKey =", vendorKey).Filter("InvoiceNum =", invoiceNum)
+	return hasActive(ctx.c, q, "Bill")
+}
+
+func (ctx *Context) GetAllBills(p *Pager) ([]*Bill, error) {
 	var bills []*Bill
-	q := datastore.NewQuery("Bill").Order("-PostedOn").Limit(10)
+	q := datastore.NewQuery("Bill").Order("-PostedOn")
 	bills = make([]*Bill, 0, 10)
-	keys, err := q.GetAll(ctx.c, &bills)
+	keys, err := ctx.getPageWhere(q, p, &bills, notDeleted)
 	if err != nil {
 		return bills, err
 	}
@@ -39,12 +143,12 @@ func (ctx *Context) GetAllBills() ([]*Bill, error) {
 	return bills, nil
 }
 
-func (ctx *Context) GetCompanyUnreconciledBills(c *Company) ([]*Bill, error) {
+func (ctx *Context) GetCompanyUnreconciledBills(c *Company, p *Pager) ([]*Bill, error) {
 
 	var bills []*Bill
-	q := datastore.NewQuery("Bill").Ancestor(c.Key).Filter("Reconciled = ", false).Order("-PostedOn").Limit(20)
+	q := datastore.NewQuery("Bill").Ancestor(c.Key).Filter("Reconciled = ", false).Order("-PostedOn")
 	bills = make([]*Bill, 0, 20)
-	keys, err := q.GetAll(ctx.c, bills)
+	keys, err := ctx.getPageWhere(q, p, &bills, notDeleted)
 	if err != nil {
 		return bills, err
 	}
@@ -57,10 +161,17 @@ func (ctx *Context) GetCompanyUnreconciledBills(c *Company) ([]*Bill, error) {
 	return bills, nil
 }
 
+// LoadBillCompanies sets Company on each bill.  Bills without a company are
+// skipped.
 func (ctx *Context) LoadBillCompanies(bills []*Bill) error {
 	var keys []*datastore.Key
+	var withKeys []*Bill
 	for _, b := range bills {
+		if b.CompanyKey == nil {
+			continue
+		}
 		keys = append(keys, b.CompanyKey)
+		withKeys = append(withKeys, b)
 	}
 
 	companies, err := ctx.GetCompanyMulti(keys)
@@ -69,17 +180,24 @@ func (ctx *Context) LoadBillCompanies(bills []*Bill) error {
 		return err
 	}
 
-	for idx, b := range bills {
+	for idx, b := range withKeys {
 		b.Company = companies[idx]
 	}
 
 	return nil
 }
 
+// LoadBillVendors sets Vendor on each bill.  Bills uploaded without a vendor
+// are skipped.
 func (ctx *Context) LoadBillVendors(bills []*Bill) error {
 	var keys []*datastore.Key
+	var withKeys []*Bill
 	for _, b := range bills {
+		if b.VendorKey == nil {
+			continue
+		}
 		keys = append(keys, b.VendorKey)
+		withKeys = append(withKeys, b)
 	}
 
 	vendors, err := ctx.GetVendorMulti(keys)
@@ -88,19 +206,19 @@ func (ctx *Context) LoadBillVendors(bills []*Bill) error {
 		return err
 	}
 
-	for idx, b := range bills {
+	for idx, b := range withKeys {
 		b.Vendor = vendors[idx]
 	}
 
 	return nil
 }
 
-func (ctx *Context) GetCompanyReconciledBills(c *Company) ([]*Bill, error) {
+func (ctx *Context) GetCompanyReconciledBills(c *Company, p *Pager) ([]*Bill, error) {
 
 	var bills []*Bill
-	q := datastore.NewQuery("Bill").Ancestor(c.Key).Filter("Reconciled = ", true).Order("-PostedOn").Limit(20)
+	q := datastore.NewQuery("Bill").Ancestor(c.Key).Filter("Reconciled = ", true).Order("-PostedOn")
 	bills = make([]*Bill, 0, 20)
-	keys, err := q.GetAll(ctx.c, &bills)
+	keys, err := ctx.getPageWhere(q, p, &bills, notDeleted)
 	if err != nil {
 		return bills, err
 	}
@@ -114,6 +232,61 @@ func (ctx *Context) GetCompanyReconciledBills(c *Company) ([]*Bill, error) {
 }
 
 func (ctx *Context) GetBillCount() (int, error) {
-	c, err := datastore.NewQuery("Bill").Count(ctx.c)
-	return c, err
+	return ctx.countActive("Bill")
+}
+
+// EditBill calls edit on the bill at key and stores the result, in a single
+// transaction.  Bills with payments cannot be edited.
+func (ctx *Context) EditBill(key *datastore.Key, edit func(c appengine.Context, b *Bill) error) (*Bill, error) {
+	b := new(Bill)
+	err := datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		err := datastore.Get(c, key, b)
+		if err != nil {
+			return err
+		}
+
+		if b.Paid || b.PaidAmt > 0 {
+			return BillStatusError("Bills with payments cannot be edited")
+		}
+
+		if b.BatchKey != nil {
+			return BillStatusError("Bills in a payment batch cannot be edited")
+		}
+
+		before := *b
+		err = edit(c, b)
+		if err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(c, key, b)
+		if err != nil {
+			return err
+		}
+
+		return ctx.recordAudit(c, AuditUpdate, key, &before, b)
+	}, nil)
+
+	b.Key = key
+	b.ID = key.IntID()
+
+	return b, err
+}
+
+// DeleteBill moves the bill at key to the trash.  Its history, payment
+// records and files are kept until it is purged.  Bills that have payments
+// must have them undone first.
+func (ctx *Context) DeleteBill(key *datastore.Key) error {
+	return ctx.moveToTrash(key, func(c appengine.Context, v interface{}) error {
+		b := v.(*Bill)
+		if b.Paid || b.PaidAmt > 0 {
+			return InUseError("The bill has payments. Undo them before deleting the bill.")
+		}
+
+		if b.BatchKey != nil {
+			return InUseError("The bill is in a payment batch. Cancel the batch before deleting the bill.")
+		}
+
+		return nil
+	})
 }
@@ -0,0 +1,227 @@
+package billing
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"appengine/datastore"
+)
+
+const (
+	BillStatusUnpaid     = "unpaid"
+	BillStatusPaid       = "paid"
+	BillStatusReconciled = "reconciled"
+)
+
+// BillFilter narrows and orders the bills shown in the admin bills list.  It
+// is read from and written back to the query string so a filtered list can
+// be bookmarked.
+//
+// Company, vendor and status are equality filters run by the datastore.
+// The datastore only allows range filters on the property a query is sorted
+// by, so the amount and date ranges are checked in memory by Match.
+type BillFilter struct {
+	InvoiceNum string
+	CompanyID  string
+	VendorID   string
+	Status     string
+	MinAmt     int
+	MaxAmt     int
+	PostedFrom time.Time
+	PostedTo   time.Time
+	DueFrom    time.Time
+	DueTo      time.Time
+	Sort       string
+
+	companyKey *datastore.Key
+	vendorKey  *datastore.Key
+}
+
+// billSorts maps the sort names used in the query string to datastore
+// orders.  Each one needs indexes in index.yaml alongside the equality
+// filters.
+var billSorts = map[string]string{
+	"posted": "-PostedOn",
+	"date":   "-Date",
+	"due":    "DueOn",
+	"amount": "-Amt",
+}
+
+var billStatuses = []string{BillStatusUnpaid, BillStatusPaid, BillStatusReconciled}
+
+func NewBillFilter(v url.Values) *BillFilter {
+	f := &BillFilter{
+		InvoiceNum: strings.TrimSpace(v.Get("invoice")),
+		CompanyID:  v.Get("company"),
+		VendorID:   v.Get("vendor"),
+		Status:     v.Get("status"),
+		MinAmt:     getFormFieldMoney(v, "min"),
+		MaxAmt:     getFormFieldMoney(v, "max"),
+		PostedFrom: getFormFieldDate(v, "posted_from"),
+		PostedTo:   getFormFieldDate(v, "posted_to"),
+		DueFrom:    getFormFieldDate(v, "due_from"),
+		DueTo:      getFormFieldDate(v, "due_to"),
+		Sort:       v.Get("sort"),
+	}
+
+	if _, ok := billSorts[f.Sort]; !ok {
+		f.Sort = "posted"
+	}
+
+	validStatus := false
+	for _, st := range billStatuses {
+		if f.Status == st {
+			validStatus = true
+		}
+	}
+	if !validStatus {
+		f.Status = ""
+	}
+
+	if k, err := datastore.DecodeKey(f.CompanyID); err == nil && f.CompanyID != "" {
+		f.companyKey = k
+	} else {
+		f.CompanyID = ""
+	}
+
+	if k, err := datastore.DecodeKey(f.VendorID); err == nil && f.VendorID != "" {
+		f.vendorKey = k
+	} else {
+		f.VendorID = ""
+	}
+
+	return f
+}
+
+func (f *BillFilter) Statuses() []string {
+	return billStatuses
+}
+
+// Values returns the filter as query string values.
+func (f *BillFilter) Values() url.Values {
+	v := url.Values{}
+	set := func(name, val string) {
+		if val != "" {
+			v.Set(name, val)
+		}
+	}
+	setAmt := func(name string, amt int) {
+		if amt > 0 {
+			v.Set(name, tmplMoney(amt))
+		}
+	}
+
+	set("invoice", f.InvoiceNum)
+	set("company", f.CompanyID)
+	set("vendor", f.VendorID)
+	set("status", f.Status)
+	setAmt("min", f.MinAmt)
+	setAmt("max", f.MaxAmt)
+	set("posted_from", tmplFormDate(f.PostedFrom))
+	set("posted_to", tmplFormDate(f.PostedTo))
+	set("due_from", tmplFormDate(f.DueFrom))
+	set("due_to", tmplFormDate(f.DueTo))
+	set("sort", f.Sort)
+
+	return v
+}
+
+// SortURL returns a link to the first page of the filtered list sorted by
+// sort.
+func (f *BillFilter) SortURL(sort string) string {
+	v := f.Values()
+	v.Set("sort", sort)
+	return "/admin/bills?" + v.Encode()
+}
+
+// query builds the datastore query for the equality filters and sort.
+func (f *BillFilter) query() *datastore.Query {
+	q := datastore.NewQuery("Bill")
+
+	if f.InvoiceNum != "" {
+		q = q.Filter("InvoiceNum =", f.InvoiceNum)
+	}
+
+	// A vendor belongs to a single company so the company filter is only
+	// needed without a vendor.
+	if f.vendorKey != nil {
+		q = q.Filter("VendorKey =", f.vendorKey)
+	} else if f.companyKey != nil {
+		q = q.Filter("CompanyKey =", f.companyKey)
+	}
+
+	switch f.Status {
+	case BillStatusUnpaid:
+		q = q.Filter("Paid =", false)
+	case BillStatusPaid:
+		q = q.Filter("Paid =", true).Filter("Reconciled =", false)
+	case BillStatusReconciled:
+		q = q.Filter("Reconciled =", true)
+	}
+
+	// Invoice numbers are looked up without a sort; there are few matches
+	// and it saves an index per sort.
+	if f.InvoiceNum == "" {
+		q = q.Order(billSorts[f.Sort])
+	}
+
+	return q
+}
+
+// Match reports whether b passes the range filters.
+func (f *BillFilter) Match(b *Bill) bool {
+	if f.MinAmt > 0 && b.Amt < f.MinAmt {
+		return false
+	}
+	if f.MaxAmt > 0 && b.Amt > f.MaxAmt {
+		return false
+	}
+	if !inDateRange(b.PostedOn, f.PostedFrom, f.PostedTo) {
+		return false
+	}
+	if !inDateRange(b.DueOn, f.DueFrom, f.DueTo) {
+		return false
+	}
+	return true
+}
+
+// HasRange reports whether any filter has to be checked in memory.
+func (f *BillFilter) HasRange() bool {
+	return f.MinAmt > 0 || f.MaxAmt > 0 || !f.PostedFrom.IsZero() || !f.PostedTo.IsZero() ||
+		!f.DueFrom.IsZero() || !f.DueTo.IsZero()
+}
+
+// inDateRange reports whether t falls on or between the days from and to.
+// A zero from or to leaves that end of the range open.
+func inDateRange(t, from, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	if !to.IsZero() && !t.Before(to.AddDate(0, 0, 1)) {
+		return false
+	}
+	return true
+}
+
+func (ctx *Context) FilterBills(f *BillFilter, p *Pager) ([]*Bill, error) {
+	match := notDeleted
+	if f.HasRange() {
+		match = func(v interface{}) bool {
+			return notDeleted(v) && f.Match(v.(*Bill))
+		}
+	}
+
+	bills := make([]*Bill, 0, 10)
+	keys, err := ctx.getPageWhere(f.query(), p, &bills, match)
+	if err != nil {
+		return bills, err
+	}
+
+	for idx, k := range keys {
+		bills[idx].ID = k.IntID()
+		bills[idx].Key = k
+	}
+
+	return bills, nil
+}
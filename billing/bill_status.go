@@ -0,0 +1,279 @@
+package billing
+
+import (
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Bill status actions.  A bill moves from posted -> approved -> paid ->
+// reconciled and can be stepped back with a reason.
+const (
+	BillActionApprove     = "approve"
+	BillActionReject      = "reject"
+	BillActionResubmit    = "resubmit"
+	BillActionPay         = "pay"
+	BillActionReconcile   = "reconcile"
+	BillActionUnpay       = "unpay"
+	BillActionUnreconcile = "unreconcile"
+)
+
+var billActionLabels = map[string]string{
+	BillActionApprove:     "Approved",
+	BillActionReject:      "Rejected",
+	BillActionResubmit:    "Resubmitted",
+	BillActionPay:         "Payment",
+	BillActionReconcile:   "Reconciled",
+	BillActionUnpay:       "Payment undone",
+	BillActionUnreconcile: "Reconciliation undone",
+}
+
+// BillEvent records a single status change on a bill.  Events are stored as
+// children of the bill so they share its entity group.
+//
+// Override holds the justification given when an admin overrode a
+// segregation of duties rule to make the change.
+type BillEvent struct {
+	Key      *datastore.Key `datastore:"-"`
+	Action   string
+	Reason   string
+	Override string
+	By       string
+	On       time.Time
+}
+
+// BillStatusError is returned when a status change is not allowed for the
+// current state of the bill.  Its message is safe to show to the user.
+type BillStatusError string
+
+func (e BillStatusError) Error() string {
+	return string(e)
+}
+
+func (ev *BillEvent) ActionLabel() string {
+	if label, ok := billActionLabels[ev.Action]; ok {
+		return label
+	}
+	return ev.Action
+}
+
+func (b *Bill) Status() string {
+	switch {
+	case b.Reconciled:
+		return "Reconciled"
+	case b.Paid:
+		return "Paid"
+	case b.PaidAmt > 0:
+		return "Partially Paid"
+	case b.AwaitingApproval():
+		return "Pending Approval"
+	case b.Rejected():
+		return "Rejected"
+	}
+	return "Posted"
+}
+
+// PastDue reports whether the bill has a balance and its due date has passed.
+func (b *Bill) PastDue() bool {
+	if b.Paid || b.DueOn.IsZero() {
+		return false
+	}
+	return b.DueOn.Before(today())
+}
+
+// Balance returns the amount still owed on the bill in cents.
+func (b *Bill) Balance() int {
+	if b.Paid {
+		return 0
+	}
+	return b.Amt - b.PaidAmt
+}
+
+func (b *Bill) EncodedKey() string {
+	if b.Key == nil {
+		return ""
+	}
+	return b.Key.Encode()
+}
+
+// applyAction changes the bill status fields for action.  It does not touch
+// the datastore.
+func (b *Bill) applyAction(action, by, reason string, now time.Time) error {
+	switch action {
+	case BillActionApprove:
+		return b.approve(by, now)
+	case BillActionReject:
+		return b.reject(by, reason, now)
+	case BillActionResubmit:
+		return b.resubmit()
+	case BillActionPay:
+		// The paid amount is updated by addPayment.
+		if b.Paid {
+			return BillStatusError("Bill is already paid")
+		}
+		if !b.Approved() {
+			return BillStatusError("Bill must be approved before it can be paid")
+		}
+	case BillActionReconcile:
+		if !b.Paid {
+			return BillStatusError("Bill must be paid before it can be reconciled")
+		}
+		if b.Reconciled {
+			return BillStatusError("Bill is already reconciled")
+		}
+		b.Reconciled = true
+		b.ReconciledOn = now
+		b.ReconciledBy = by
+	case BillActionUnpay:
+		if reason == "" {
+			return BillStatusError("You must give a reason to undo a payment")
+		}
+		if !b.Paid && b.PaidAmt == 0 {
+			return BillStatusError("Bill has no payments to undo")
+		}
+		if b.Reconciled {
+			return BillStatusError("Bill must be unreconciled before the payment can be undone")
+		}
+		if b.BatchKey != nil {
+			return BillStatusError("Bill is in a payment batch. Cancel the batch before undoing its payments")
+		}
+		b.Paid = false
+		b.PaidAmt = 0
+		b.DiscountTaken = 0
+		b.PaidOn = time.Time{}
+		b.PaidBy = ""
+		b.SettledOn = time.Time{}
+	case BillActionUnreconcile:
+		if reason == "" {
+			return BillStatusError("You must give a reason to undo a reconciliation")
+		}
+		if !b.Reconciled {
+			return BillStatusError("Bill is not reconciled")
+		}
+		b.Reconciled = false
+		b.ReconciledOn = time.Time{}
+		b.ReconciledBy = ""
+	default:
+		return BillStatusError("Unknown bill action: " + action)
+	}
+
+	return nil
+}
+
+// UpdateBillStatus applies action to the bill stored at key and records a
+// BillEvent, both in a single transaction.  Undoing a payment voids every
+// payment recorded against the bill.  Payments are recorded with PayBill.
+//
+// justification is only used when an admin overrides a segregation of
+// duties rule of the bill's company.
+func (ctx *Context) UpdateBillStatus(key *datastore.Key, action, reason, justification string) (*Bill, error) {
+	if action == BillActionPay {
+		return nil, BillStatusError("Payment details are required to mark a bill paid")
+	}
+
+	return ctx.updateBill(key, action, reason, justification, func(c appengine.Context, b *Bill) error {
+		if action != BillActionUnpay {
+			return nil
+		}
+		return voidPayments(c, key, ctx.user.String(), reason, time.Now())
+	})
+}
+
+// updateBill runs the status change for action inside a transaction, after
+// checking that the bill is not in the trash, the segregation of duties
+// rules of the bill's company and, for payments, that the vendor's payments
+// are not on hold.  If extra is not nil it is called in the same
+// transaction after the status change has been applied and before the bill
+// is saved, so it may modify b.
+func (ctx *Context) updateBill(key *datastore.Key, action, reason, justification string, extra func(c appengine.Context, b *Bill) error) (*Bill, error) {
+	b := new(Bill)
+	by := ctx.user.String()
+
+	err := datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		err := datastore.Get(c, key, b)
+		if err != nil {
+			return err
+		}
+
+		if b.Deleted {
+			return BillStatusError("Bill is in the trash")
+		}
+
+		before := *b
+
+		override := ""
+		if b.CompanyKey != nil {
+			company := new(Company)
+			err = datastore.Get(c, b.CompanyKey, company)
+			if err != nil {
+				return err
+			}
+
+			override, err = ctx.checkDuties(company, b, action, by, justification)
+			if err != nil {
+				return err
+			}
+		}
+
+		if action == BillActionPay {
+			err = paymentHold(c, b.VendorKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		err = b.applyAction(action, by, reason, now)
+		if err != nil {
+			return err
+		}
+
+		if extra != nil {
+			err = extra(c, b)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = datastore.Put(c, key, b)
+		if err != nil {
+			return err
+		}
+
+		err = ctx.recordAudit(c, AuditUpdate, key, &before, b)
+		if err != nil {
+			return err
+		}
+
+		ev := BillEvent{
+			Action:   action,
+			Reason:   reason,
+			Override: override,
+			By:       by,
+			On:       now,
+		}
+		_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "BillEvent", key), &ev)
+		return err
+	}, nil)
+
+	b.Key = key
+	b.ID = key.IntID()
+
+	return b, err
+}
+
+func (ctx *Context) GetBillEvents(b *Bill) ([]*BillEvent, error) {
+	events := make([]*BillEvent, 0, 10)
+	q := datastore.NewQuery("BillEvent").Ancestor(b.Key).Order("On")
+	keys, err := q.GetAll(ctx.c, &events)
+	if err != nil {
+		return events, err
+	}
+
+	for idx, k := range keys {
+		events[idx].Key = k
+	}
+
+	return events, nil
+}
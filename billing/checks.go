@@ -0,0 +1,544 @@
+package billing
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// checkStubLines is how many bills fit on a remittance stub.  A vendor
+// paid for more bills at once gets several checks.
+const checkStubLines = 10
+
+// firstCheckNum is the check number used on accounts whose next check
+// number has not been set.  maxCheckNum is the largest check number.
+const (
+	firstCheckNum = 1001
+	maxCheckNum   = 999999
+)
+
+// CheckSequence is the number of the next check written on the bank
+// account with AccountNumber.  Each account has its own checkbook, so
+// numbering starts over when the company changes accounts.
+type CheckSequence struct {
+	AccountNumber string
+	Next          int
+}
+
+// Check is one printed check of a check batch and the bills it pays.
+type Check struct {
+	Num        int
+	VendorName string
+	RemitTo    Address
+	Amt        int
+	Entries    []BatchEntry
+}
+
+// Paid reports whether every bill of the check has been marked paid.
+func (chk *Check) Paid() bool {
+	for _, e := range chk.Entries {
+		if !e.Paid {
+			return false
+		}
+	}
+	return true
+}
+
+// Voided reports whether the check has been voided.
+func (chk *Check) Voided() bool {
+	for _, e := range chk.Entries {
+		if !e.Voided {
+			return false
+		}
+	}
+	return len(chk.Entries) > 0
+}
+
+// VoidedOn returns when the check was voided.
+func (chk *Check) VoidedOn() time.Time {
+	return chk.Entries[0].VoidedOn
+}
+
+func (chk *Check) VoidReason() string {
+	return chk.Entries[0].VoidReason
+}
+
+// Memo lists the invoices the check pays, for the memo line.  Checks that
+// pay many bills refer to the stub instead.
+func (chk *Check) Memo() string {
+	if len(chk.Entries) > 3 {
+		return "Invoices listed on stub"
+	}
+
+	nums := []string{}
+	for _, e := range chk.Entries {
+		nums = append(nums, e.InvoiceNum)
+	}
+	return "Invoice " + strings.Join(nums, ", ")
+}
+
+// CanPrintChecks reports whether the company has the account details
+// printed on its checks.
+func (c *Company) CanPrintChecks() bool {
+	return c.Bank.RoutingNumber != "" && c.Bank.AccountNumber != ""
+}
+
+// NextCheck returns the number of the next check the company writes on its
+// current bank account.
+func (c *Company) NextCheck() int {
+	for _, s := range c.CheckNumbers {
+		if s.AccountNumber == c.Bank.AccountNumber && s.Next > 0 {
+			return s.Next
+		}
+	}
+	return firstCheckNum
+}
+
+// setNextCheck sets the number of the next check written on the current
+// bank account of the company.
+func (c *Company) setNextCheck(n int) {
+	for idx := range c.CheckNumbers {
+		if c.CheckNumbers[idx].AccountNumber == c.Bank.AccountNumber {
+			c.CheckNumbers[idx].Next = n
+			return
+		}
+	}
+	c.CheckNumbers = append(c.CheckNumbers, CheckSequence{c.Bank.AccountNumber, n})
+}
+
+// numberChecks gives the entries of a check batch their check numbers,
+// starting at first.  It returns the number after the last check.
+func numberChecks(entries []BatchEntry, first int) int {
+	vendors := make([]string, len(entries))
+	for idx, e := range entries {
+		vendors[idx] = e.VendorKey.Encode()
+	}
+
+	nums, next := checkNumbers(vendors, first)
+	for idx := range entries {
+		entries[idx].CheckNum = nums[idx]
+	}
+	return next
+}
+
+// checkNumbers returns the check number of each bill paid to vendors,
+// starting at first: one check per vendor, or several for vendors with more
+// bills than fit on a stub.  It also returns the number after the last
+// check.
+func checkNumbers(vendors []string, first int) ([]int, int) {
+	next := first
+	nums := make([]int, len(vendors))
+	open := map[string]int{}
+	count := map[int]int{}
+	for idx, vendor := range vendors {
+		num, ok := open[vendor]
+		if !ok || count[num] == checkStubLines {
+			num = next
+			next++
+			open[vendor] = num
+		}
+		nums[idx] = num
+		count[num]++
+	}
+	return nums, next
+}
+
+// Checks returns the checks of the batch in check number order.
+func (pb *PaymentBatch) Checks() []*Check {
+	byNum := map[int]*Check{}
+	nums := []int{}
+	for _, e := range pb.Entries {
+		if e.CheckNum == 0 {
+			continue
+		}
+		chk, ok := byNum[e.CheckNum]
+		if !ok {
+			chk = &Check{Num: e.CheckNum, VendorName: e.VendorName, RemitTo: e.RemitTo}
+			byNum[e.CheckNum] = chk
+			nums = append(nums, e.CheckNum)
+		}
+		chk.Amt += e.Amt
+		chk.Entries = append(chk.Entries, e)
+	}
+
+	sort.Ints(nums)
+	checks := make([]*Check, len(nums))
+	for i, n := range nums {
+		checks[i] = byNum[n]
+	}
+	return checks
+}
+
+// VoidCheck voids check num of the check batch pb.  Bills the check paid
+// have its payment voided and are unpaid again; bills of a batch that is not
+// yet confirmed are released from it.  Either way they can then be paid
+// another way.  A check that paid a reconciled bill has cleared the bank
+// and cannot be voided.  justification is used as in UpdateBillStatus.
+func (ctx *Context) VoidCheck(pb *PaymentBatch, num int, reason, justification string) error {
+	if !pb.IsCheck() {
+		return BillStatusError("This payment batch has no checks")
+	}
+
+	if strings.TrimSpace(reason) == "" {
+		return BillStatusError("You must give a reason to void a check")
+	}
+
+	entries := []int{}
+	for idx, e := range pb.Entries {
+		if e.CheckNum == num && !e.Voided {
+			entries = append(entries, idx)
+		}
+	}
+
+	if len(entries) == 0 {
+		return BillStatusError(fmt.Sprintf("Check %d is not an outstanding check of this batch", num))
+	}
+
+	// Check every bill before voiding any payment so a cleared check is not
+	// left half voided.
+	for _, idx := range entries {
+		b := new(Bill)
+		err := datastore.Get(ctx.c, pb.Entries[idx].BillKey, b)
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if b.Reconciled {
+			return BillStatusError(fmt.Sprintf("Check %d has cleared the bank and cannot be voided", num))
+		}
+	}
+
+	ref := strconv.Itoa(num)
+	by := ctx.user.String()
+	now := time.Now()
+
+	// Each entry is voided in the transaction that unpays or releases its
+	// bill.  An entry paid or voided since pb was loaded is left alone.
+	void := func(c appengine.Context, idx int, paid bool) error {
+		batch, e, err := batchEntry(c, pb.Key, idx)
+		if err != nil {
+			return err
+		}
+
+		if e.Voided || e.Paid != paid {
+			return BillStatusError(fmt.Sprintf("Check %d changed while it was being voided. Try again", num))
+		}
+
+		e.Paid = false
+		e.Error = ""
+		e.Voided = true
+		e.VoidedOn = now
+		e.VoidedBy = by
+		e.VoidReason = reason
+		if batch.Open() && batch.VoidedCount() == len(batch.Entries) {
+			batch.State = BatchCancelled
+		}
+
+		_, err = datastore.Put(c, pb.Key, batch)
+		return err
+	}
+
+	for _, idx := range entries {
+		idx, e := idx, pb.Entries[idx]
+		var err error
+		if e.Paid {
+			_, err = ctx.updateBill(e.BillKey, BillActionUnpay, reason, justification, func(c appengine.Context, b *Bill) error {
+				err := voidCheckPayments(c, e.BillKey, b, ref, by, reason, now)
+				if err != nil {
+					return err
+				}
+				return void(c, idx, true)
+			})
+		} else {
+			err = datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+				err := ctx.releaseBill(c, e.BillKey, pb.Key)
+				if err != nil {
+					return err
+				}
+				return void(c, idx, false)
+			}, nil)
+		}
+
+		// A bill that no longer exists has nothing to unpay, but its entry
+		// is still voided.
+		if err == datastore.ErrNoSuchEntity {
+			err = datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+				return void(c, idx, e.Paid)
+			}, nil)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// voidCheckPayments voids the payments by check ref on the bill at key and
+// sets the paid amount of b to the payments that are left.  It must be
+// called inside a transaction on the bill's entity group.
+func voidCheckPayments(c appengine.Context, key *datastore.Key, b *Bill, ref, by, reason string, now time.Time) error {
+	var payments []*Payment
+	keys, err := datastore.NewQuery("Payment").Ancestor(key).Filter("Voided =", false).GetAll(c, &payments)
+	if err != nil {
+		return err
+	}
+
+	b.PaidAmt = 0
+	voided := []*Payment{}
+	voidedKeys := []*datastore.Key{}
+	for idx, p := range payments {
+		if p.Method != PaymentMethodCheck || p.Reference != ref {
+			b.PaidAmt += p.Amt
+			continue
+		}
+
+		p.Voided = true
+		p.VoidedBy = by
+		p.VoidedOn = now
+		p.VoidReason = reason
+		voided = append(voided, p)
+		voidedKeys = append(voidedKeys, keys[idx])
+	}
+
+	_, err = datastore.PutMulti(c, voidedKeys, voided)
+	return err
+}
+
+var (
+	ones = []string{"", "One", "Two", "Three", "Four", "Five", "Six", "Seven", "Eight", "Nine",
+		"Ten", "Eleven", "Twelve", "Thirteen", "Fourteen", "Fifteen", "Sixteen", "Seventeen", "Eighteen", "Nineteen"}
+	tens   = []string{"", "", "Twenty", "Thirty", "Forty", "Fifty", "Sixty", "Seventy", "Eighty", "Ninety"}
+	scales = []string{"", "Thousand", "Million", "Billion"}
+)
+
+// hundredsInWords spells n, which is below 1000.
+func hundredsInWords(n int) string {
+	words := []string{}
+	if n >= 100 {
+		words = append(words, ones[n/100], "Hundred")
+		n %= 100
+	}
+	if n >= 20 {
+		w := tens[n/10]
+		if n%10 != 0 {
+			w += "-" + ones[n%10]
+		}
+		words = append(words, w)
+	} else if n > 0 {
+		words = append(words, ones[n])
+	}
+	return strings.Join(words, " ")
+}
+
+// amountInWords spells an amount in cents the way it is written on a
+// check: "One Thousand Two Hundred Thirty-Four and 56/100 Dollars".
+func amountInWords(cents int) string {
+	dollars := cents / 100
+
+	words := []string{}
+	for scale := 0; dollars > 0; scale++ {
+		if n := dollars % 1000; n > 0 {
+			w := hundredsInWords(n)
+			if scales[scale] != "" {
+				w += " " + scales[scale]
+			}
+			words = append([]string{w}, words...)
+		}
+		dollars /= 1000
+	}
+
+	if len(words) == 0 {
+		words = []string{"Zero"}
+	}
+
+	return fmt.Sprintf("%s and %02d/100 Dollars", strings.Join(words, " "), cents%100)
+}
+
+// checkAmount formats an amount for the amount box of a check, with
+// thousands separators and asterisks so it cannot be altered.
+func checkAmount(cents int) string {
+	s := strconv.Itoa(cents / 100)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return fmt.Sprintf("**%s.%02d", s, cents%100)
+}
+
+// micrLine returns the MICR line of a check: the check number, routing
+// number and account number, with the on-us and transit symbols written as
+// C and A, the characters MICR E-13B fonts use for them.
+func micrLine(num int, b BankAccount) string {
+	return fmt.Sprintf("C%06dC A%sA %sC", num, b.RoutingNumber, b.AccountNumber)
+}
+
+// GenerateChecks returns a PDF with a page for each check of the batch that
+// is not voided, for check stock with the check at the top and two
+// remittance stubs below.
+func GenerateChecks(c *Company, pb *PaymentBatch) ([]byte, error) {
+	if !c.CanPrintChecks() {
+		return nil, fmt.Errorf("company %s has no bank account for checks", c.Name)
+	}
+
+	d := &pdfDoc{}
+	printed := 0
+	for _, chk := range pb.Checks() {
+		if chk.Voided() {
+			continue
+		}
+
+		printed++
+		d.newPage()
+		printCheck(d, c, pb, chk)
+		printStub(d, 264, c, pb, chk)
+		printStub(d, 528, c, pb, chk)
+	}
+
+	if printed == 0 {
+		return nil, BillStatusError("There are no checks to print")
+	}
+
+	return d.bytes(), nil
+}
+
+// printCheck draws the check itself in the top third of the page.
+func printCheck(d *pdfDoc, c *Company, pb *PaymentBatch, chk *Check) {
+	d.text(36, 48, fontBold, 12, c.Name)
+	d.text(36, 62, fontRegular, 9, c.Bank.BankName)
+	d.text(480, 48, fontBold, 12, strconv.Itoa(chk.Num))
+	d.text(420, 82, fontRegular, 10, "Date")
+	d.text(460, 82, fontMono, 10, pb.EffectiveOn.Format("01/02/2006"))
+
+	d.text(36, 116, fontRegular, 8, "PAY TO THE")
+	d.text(36, 126, fontRegular, 8, "ORDER OF")
+	d.text(90, 124, fontRegular, 11, chk.VendorName)
+	d.line(88, 128, 440, 128)
+	d.rect(460, 110, 116, 22)
+	d.textRight(570, 125, 11, checkAmount(chk.Amt))
+
+	d.text(36, 152, fontRegular, 10, amountInWords(chk.Amt)+" "+strings.Repeat("*", 10))
+	d.line(36, 156, 576, 156)
+
+	y := 176.0
+	d.text(90, y, fontRegular, 10, chk.VendorName)
+	for _, l := range chk.RemitTo.Lines() {
+		y += 12
+		d.text(90, y, fontRegular, 10, l)
+	}
+
+	d.text(36, 226, fontRegular, 8, "MEMO")
+	d.text(70, 226, fontRegular, 9, chk.Memo())
+	d.line(68, 228, 300, 228)
+	d.line(360, 228, 576, 228)
+	d.text(420, 238, fontRegular, 7, "AUTHORIZED SIGNATURE")
+
+	d.text(150, 250, fontMono, 12, micrLine(chk.Num, c.Bank))
+	d.dashed(0, 264, pageWidth, 264)
+}
+
+// printStub draws a remittance stub listing the bills the check pays, in
+// the third of the page starting at top.
+func printStub(d *pdfDoc, top float64, c *Company, pb *PaymentBatch, chk *Check) {
+	d.text(36, top+24, fontBold, 10, c.Name)
+	d.text(300, top+24, fontRegular, 10, "Check "+strconv.Itoa(chk.Num))
+	d.text(420, top+24, fontRegular, 10, pb.EffectiveOn.Format("01/02/2006"))
+	d.text(36, top+38, fontRegular, 10, chk.VendorName)
+
+	y := top + 60
+	d.text(36, y, fontBold, 9, "Invoice")
+	d.text(200, y, fontBold, 9, "Date")
+	d.text(330, y, fontBold, 9, "Discount")
+	d.text(480, y, fontBold, 9, "Amount Paid")
+	d.line(36, y+4, 576, y+4)
+
+	for _, e := range chk.Entries {
+		y += 14
+		d.text(36, y, fontRegular, 9, e.InvoiceNum)
+		d.text(200, y, fontMono, 9, tmplDate(e.InvoiceDate))
+		if e.Discount > 0 {
+			d.textRight(380, y, 9, tmplMoney(e.Discount))
+		}
+		d.textRight(570, y, 9, tmplMoney(e.Amt))
+	}
+
+	y += 8
+	d.line(36, y, 576, y)
+	d.text(430, y+14, fontBold, 9, "Total")
+	d.textRight(570, y+14, 9, tmplMoney(chk.Amt))
+
+	if top+264 < pageHeight {
+		d.dashed(0, top+264, pageWidth, top+264)
+	}
+}
+
+// registerLines is how many checks fit on a page of the check register.
+const registerLines = 40
+
+// GenerateCheckRegister returns a PDF listing the checks of the batch, for
+// the company's records.  Voided checks are totalled on their own line.
+func GenerateCheckRegister(c *Company, pb *PaymentBatch, now time.Time) ([]byte, error) {
+	checks := pb.Checks()
+	if len(checks) == 0 {
+		return nil, fmt.Errorf("payment batch %s has no checks", pb.Reference)
+	}
+
+	d := &pdfDoc{}
+	total, voidedTotal, voided := 0, 0, 0
+	for i, chk := range checks {
+		if i%registerLines == 0 {
+			d.newPage()
+			d.text(36, 48, fontBold, 14, "Check Register")
+			d.text(36, 64, fontRegular, 10, fmt.Sprintf("%s, account %s, batch %s", c.Name, c.Bank.MaskedAccount(), pb.Reference))
+			d.text(36, 76, fontRegular, 10, "Printed "+now.Format("01/02/2006 15:04"))
+			d.text(36, 100, fontBold, 9, "Check")
+			d.text(90, 100, fontBold, 9, "Date")
+			d.text(160, 100, fontBold, 9, "Payee")
+			d.text(380, 100, fontBold, 9, "Bills")
+			d.text(420, 100, fontBold, 9, "Status")
+			d.text(530, 100, fontBold, 9, "Amount")
+			d.line(36, 104, 576, 104)
+		}
+
+		y := 118 + float64(i%registerLines)*14
+		status := "Printed"
+		if chk.Paid() {
+			status = "Paid"
+		}
+		if chk.Voided() {
+			status = "Voided"
+		}
+
+		d.text(36, y, fontMono, 9, strconv.Itoa(chk.Num))
+		d.text(90, y, fontMono, 9, pb.EffectiveOn.Format("01/02/06"))
+		d.text(160, y, fontRegular, 9, chk.VendorName)
+		d.text(380, y, fontMono, 9, strconv.Itoa(len(chk.Entries)))
+		d.text(420, y, fontRegular, 9, status)
+		d.textRight(570, y, 9, tmplMoney(chk.Amt))
+		if chk.Voided() {
+			voided++
+			voidedTotal += chk.Amt
+		} else {
+			total += chk.Amt
+		}
+	}
+
+	y := 118 + float64((len(checks)-1)%registerLines)*14 + 8
+	d.line(36, y, 576, y)
+	d.text(36, y+14, fontBold, 9, fmt.Sprintf("%d checks", len(checks)-voided))
+	d.textRight(570, y+14, 9, tmplMoney(total))
+	if voided > 0 {
+		d.text(36, y+28, fontRegular, 9, fmt.Sprintf("%d voided checks, not included", voided))
+		d.textRight(570, y+28, 9, tmplMoney(voidedTotal))
+	}
+
+	return d.bytes(), nil
+}
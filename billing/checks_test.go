@@ -0,0 +1,88 @@
+package billing
+
+import "testing"
+
+func TestAmountInWords(t *testing.T) {
+	tests := []struct {
+		cents int
+		words string
+	}{
+		{0, "Zero and 00/100 Dollars"},
+		{5, "Zero and 05/100 Dollars"},
+		{100, "One and 00/100 Dollars"},
+		{1900, "Nineteen and 00/100 Dollars"},
+		{2101, "Twenty-One and 01/100 Dollars"},
+		{123456, "One Thousand Two Hundred Thirty-Four and 56/100 Dollars"},
+		{1500000, "Fifteen Thousand and 00/100 Dollars"},
+		{2000199, "Twenty Thousand One and 99/100 Dollars"},
+		{100000000, "One Million and 00/100 Dollars"},
+		{9999999999, "Ninety-Nine Million Nine Hundred Ninety-Nine Thousand Nine Hundred Ninety-Nine and 99/100 Dollars"},
+	}
+
+	for _, tt := range tests {
+		if got := amountInWords(tt.cents); got != tt.words {
+			t.Errorf("amountInWords(%d) = %q, want %q", tt.cents, got, tt.words)
+		}
+	}
+}
+
+func TestCheckAmount(t *testing.T) {
+	tests := []struct {
+		cents int
+		s     string
+	}{
+		{5, "**0.05"},
+		{123456, "**1,234.56"},
+		{100000000, "**1,000,000.00"},
+	}
+
+	for _, tt := range tests {
+		if got := checkAmount(tt.cents); got != tt.s {
+			t.Errorf("checkAmount(%d) = %q, want %q", tt.cents, got, tt.s)
+		}
+	}
+}
+
+func TestCheckNumbers(t *testing.T) {
+	vendors := func(v string, n int) []string {
+		ids := []string{}
+		for i := 0; i < n; i++ {
+			ids = append(ids, v)
+		}
+		return ids
+	}
+
+	checks := func(num, n int) []int {
+		nums := []int{}
+		for i := 0; i < n; i++ {
+			nums = append(nums, num)
+		}
+		return nums
+	}
+
+	tests := []struct {
+		name    string
+		vendors []string
+		first   int
+		nums    []int
+		next    int
+	}{
+		{"one bill", []string{"a"}, 1001, []int{1001}, 1002},
+		{"one check per vendor", []string{"a", "b", "a"}, 1001, []int{1001, 1002, 1001}, 1003},
+		{"full stub", vendors("a", checkStubLines), 7, checks(7, checkStubLines), 8},
+		{"stub overflow", append(vendors("a", checkStubLines+1), "b"), 500, append(append(checks(500, checkStubLines), 501), 502), 503},
+	}
+
+	for _, tt := range tests {
+		nums, next := checkNumbers(tt.vendors, tt.first)
+		if next != tt.next {
+			t.Errorf("%s: next check %d, want %d", tt.name, next, tt.next)
+		}
+
+		for i, num := range tt.nums {
+			if nums[i] != num {
+				t.Errorf("%s: bill %d on check %d, want %d", tt.name, i, nums[i], num)
+			}
+		}
+	}
+}
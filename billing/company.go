@@ -13,8 +13,35 @@ type Company struct {
 	Name      string
 	CreatedBy string
 	CreatedOn time.Time
-	Users     []*User
-	Vendors   []*Vendor
+
+	// ApprovalRules is the approval chain bills of the company go through
+	// before they can be paid.
+	ApprovalRules []ApprovalRule
+
+	// DutyWaivers lists the segregation of duties rules the company does
+	// not enforce.
+	DutyWaivers []string
+
+	// Bank is the account the company pays its bills from and
+	// ACHCompanyID identifies the company in the ACH files it originates.
+	// CheckNumbers holds the next check number of each account the company
+	// has written checks on and PositivePay how the bank wants the checks
+	// reported.  Currency is the ISO 4217 code of the account, which the
+	// company's bills are in.
+	Bank         BankAccount
+	ACHCompanyID string
+	CheckNumbers []CheckSequence
+	PositivePay  PositivePaySettings
+	Currency     string
+
+	// A deleted company stays in the trash until it is restored or purged.
+	Deleted   bool
+	DeletedOn time.Time
+	DeletedBy string
+
+	Users   []*User   `datastore:"-"`
+	Vendors []*Vendor `datastore:"-"`
+	Bills   []*Bill   `datastore:"-"`
 }
 
 // defaultCompanyKey returns the key used for all company entries.
@@ -23,11 +50,11 @@ func defaultCompanyKey(c appengine.Context) *datastore.Key {
 	return datastore.NewKey(c, "Company", "all_companies", 0, nil)
 }
 
-func (ctx *Context) GetAllCompanies() ([]*Company, error) {
+func (ctx *Context) GetAllCompanies(p *Pager) ([]*Company, error) {
 	var companies []*Company
-	q := datastore.NewQuery("Company").Ancestor(defaultCompanyKey(ctx.c)).Order("Name").Limit(10)
+	q := datastore.NewQuery("Company").Ancestor(defaultCompanyKey(ctx.c)).Order("Name")
 	companies = make([]*Company, 0, 10)
-	keys, err := q.GetAll(ctx.c, &companies)
+	keys, err := ctx.getPageWhere(q, p, &companies, notDeleted)
 	if err != nil {
 		return companies, err
 	}
@@ -44,6 +71,7 @@ func (ctx *Context) GetCompanyByID(id string) (*Company, error) {
 	c := new(Company)
 	k, err := datastore.DecodeKey(id)
 
+	c.ID = id
 	c.Key = k
 
 	if err != nil {
@@ -69,6 +97,63 @@ func (ctx *Context) GetCompanyMulti(keys []*datastore.Key) ([]*Company, error) {
 }
 
 func (ctx *Context) GetCompanyCount() (int, error) {
-	c, err := datastore.NewQuery("Company").Count(ctx.c)
-	return c, err
+	return ctx.countActive("Company")
+}
+
+// InUseError is returned when an entity cannot be deleted because other
+// entities still belong to it.  Its message is safe to show to the user.
+type InUseError string
+
+func (e InUseError) Error() string {
+	return string(e)
+}
+
+// companyHasDependents reports whether any user, vendor or bill that is not
+// in the trash belongs to the company at key.  It may be run inside a
+// transaction.
+func companyHasDependents(c appengine.Context, key *datastore.Key) (bool, error) {
+	for _, kind := range []string{"User", "Vendor", "Bill"} {
+		found, err := hasActive(c, datastore.NewQuery(kind).Ancestor(key), kind)
+		if err != nil || found {
+			return found, err
+		}
+	}
+
+	return false, nil
+}
+
+func (ctx *Context) UpdateCompany(key *datastore.Key, name string) error {
+	return datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		company := new(Company)
+		err := datastore.Get(c, key, company)
+		if err != nil {
+			return err
+		}
+
+		before := *company
+		company.Name = name
+		_, err = datastore.Put(c, key, company)
+		if err != nil {
+			return err
+		}
+
+		return ctx.recordAudit(c, AuditUpdate, key, &before, company)
+	}, nil)
+}
+
+// DeleteCompany moves the company at key to the trash.  Companies that
+// still have users, vendors or bills are not deleted.
+func (ctx *Context) DeleteCompany(key *datastore.Key) error {
+	return ctx.moveToTrash(key, func(c appengine.Context, v interface{}) error {
+		found, err := companyHasDependents(c, key)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			return InUseError("The company still has users, vendors or bills. Remove them before deleting the company.")
+		}
+
+		return nil
+	})
 }
@@ -21,6 +21,7 @@ type UserSession struct {
 
 type UserPage struct {
 	Session   *UserSession
+	Perms     map[string]bool
 	LogoutURL string
 	User      *UserInfo
 	Flashes   []interface{}
@@ -125,6 +126,7 @@ func (c *Context) Render(t *template.Template, content interface{}) error {
 
 		if c.session != nil {
 			p.Session = c.userSession
+			p.Perms = c.Permissions()
 		}
 	}
 
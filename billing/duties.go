@@ -0,0 +1,127 @@
+package billing
+
+import (
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Segregation of duties rules.  Every rule is enforced unless the company
+// waives it.
+const (
+	DutyPosterApprove = "poster_approve"
+	DutyApproverPay   = "approver_pay"
+)
+
+type DutyRule struct {
+	Code  string
+	Label string
+}
+
+var dutyRules = []DutyRule{
+	{DutyPosterApprove, "The person who posted a bill cannot approve it"},
+	{DutyApproverPay, "An approver of a bill cannot pay it"},
+}
+
+// Enforces reports whether the company applies the duty rule code.
+func (c *Company) Enforces(code string) bool {
+	for _, w := range c.DutyWaivers {
+		if w == code {
+			return false
+		}
+	}
+	return true
+}
+
+// dutyViolation returns the reason by may not take action on b under the
+// company rules, or "" if the action is allowed.
+func (c *Company) dutyViolation(b *Bill, action, by string) string {
+	switch action {
+	case BillActionApprove:
+		if c.Enforces(DutyPosterApprove) && b.PostedBy == by {
+			return "You posted this bill and cannot approve it"
+		}
+	case BillActionPay:
+		if c.Enforces(DutyApproverPay) && b.ApprovedBy(by) {
+			return "You approved this bill and cannot pay it"
+		}
+	}
+	return ""
+}
+
+// checkDuties enforces the duty rules of company c for action on b.  Admins
+// may override a rule by giving a justification, which is returned so it
+// can be recorded with the status change.
+func (ctx *Context) checkDuties(c *Company, b *Bill, action, by, justification string) (string, error) {
+	msg := c.dutyViolation(b, action, by)
+	if msg == "" {
+		return "", nil
+	}
+
+	if !ctx.admin {
+		return "", BillStatusError(msg)
+	}
+
+	if justification == "" {
+		return "", BillStatusError(msg + ". A justification is required to override this rule")
+	}
+
+	return justification, nil
+}
+
+// SetDutyWaivers replaces the segregation of duties rules company c waives.
+func (ctx *Context) SetDutyWaivers(c *Company, waivers []string) error {
+	return datastore.RunInTransaction(ctx.c, func(tc appengine.Context) error {
+		company := new(Company)
+		err := datastore.Get(tc, c.Key, company)
+		if err != nil {
+			return err
+		}
+
+		before := *company
+		company.DutyWaivers = waivers
+		_, err = datastore.Put(tc, c.Key, company)
+		if err != nil {
+			return err
+		}
+
+		return ctx.recordAudit(tc, AuditUpdate, c.Key, &before, company)
+	}, nil)
+}
+
+type DutiesForm struct {
+	Company *Company
+	Rules   []DutyRule
+}
+
+func handleAdminCompanyDuties(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	c, err := ctx.GetCompanyByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	if r.Method != "POST" {
+		return ctx.renderAdmin(companyDutiesTmpl, DutiesForm{c, dutyRules})
+	}
+
+	enforced := map[string]bool{}
+	for _, code := range r.Form["enforce"] {
+		enforced[code] = true
+	}
+
+	waivers := []string{}
+	for _, rule := range dutyRules {
+		if !enforced[rule.Code] {
+			waivers = append(waivers, rule.Code)
+		}
+	}
+
+	err = ctx.SetDutyWaivers(c, waivers)
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Segregation of duties rules saved")
+	return ctx.Redirect("/admin/company/view?id=" + c.ID)
+}
@@ -1,9 +1,14 @@
 package billing
 
 import (
+	"math"
 	"strconv"
+	"strings"
+	"time"
 )
 
+const formDateLayout = "2006-01-02"
+
 func getFormFieldString(m map[string][]string, f string) string {
 	if res, ok := m[f]; ok {
 		if len(res) > 0 {
@@ -28,3 +33,39 @@ func getFormFieldInt(m map[string][]string, f string) int {
 
 	return val
 }
+
+// getFormFieldMoney parses a dollar amount such as "1,234.56" into cents.
+// It returns 0 if the field is missing or invalid.
+func getFormFieldMoney(m map[string][]string, f string) int {
+	res := strings.TrimSpace(getFormFieldString(m, f))
+	res = strings.TrimPrefix(res, "$")
+	res = strings.Replace(res, ",", "", -1)
+	if res == "" {
+		return 0
+	}
+
+	val, err := strconv.ParseFloat(res, 64)
+
+	if err != nil {
+		return 0
+	}
+
+	return int(math.Floor(val*100 + 0.5))
+}
+
+// getFormFieldDate parses a date in the format used by html date inputs.  It
+// returns the zero time if the field is missing or invalid.
+func getFormFieldDate(m map[string][]string, f string) time.Time {
+	res := strings.TrimSpace(getFormFieldString(m, f))
+	if res == "" {
+		return time.Time{}
+	}
+
+	val, err := time.Parse(formDateLayout, res)
+
+	if err != nil {
+		return time.Time{}
+	}
+
+	return val
+}
@@ -0,0 +1,412 @@
+package billing
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pain001Namespace is the namespace of the ISO 20022 customer credit
+// transfer initiation message, version 3, which banks accept for SEPA and
+// international transfers.
+const pain001Namespace = "urn:iso:std:iso:20022:tech:xsd:pain.001.001.03"
+
+// Patterns and lengths of the pain.001.001.03 schema types used.
+var (
+	isoCurrency = regexp.MustCompile(`^[A-Z]{3}$`)
+	isoIBAN     = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[a-zA-Z0-9]{1,30}$`)
+	isoBIC      = regexp.MustCompile(`^[A-Z]{6}[A-Z2-9][A-NP-Z0-9]([A-Z0-9]{3})?$`)
+
+	// isoText is the character set SEPA allows in text fields.  Other
+	// characters are replaced with spaces so every bank accepts the file.
+	isoText   = regexp.MustCompile(`[^a-zA-Z0-9/\-?:().,'+ ]`)
+	isoSpaces = regexp.MustCompile(`  +`)
+)
+
+// latinASCII pairs accented Latin letters, common in European vendor
+// names, with their ASCII spelling.
+var latinASCII = []string{
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "ae", "å", "a", "æ", "ae",
+	"ç", "c", "è", "e", "é", "e", "ê", "e", "ë", "e", "ì", "i", "í", "i",
+	"î", "i", "ï", "i", "ñ", "n", "ò", "o", "ó", "o", "ô", "o", "õ", "o",
+	"ö", "oe", "ø", "o", "ù", "u", "ú", "u", "û", "u", "ü", "ue", "ý", "y",
+	"ÿ", "y", "ß", "ss", "À", "A", "Á", "A", "Â", "A", "Ã", "A", "Ä", "Ae",
+	"Å", "A", "Æ", "Ae", "Ç", "C", "È", "E", "É", "E", "Ê", "E", "Ë", "E",
+	"Ì", "I", "Í", "I", "Î", "I", "Ï", "I", "Ñ", "N", "Ò", "O", "Ó", "O",
+	"Ô", "O", "Õ", "O", "Ö", "Oe", "Ø", "O", "Ù", "U", "Ú", "U", "Û", "U",
+	"Ü", "Ue", "Ý", "Y",
+}
+
+// asciiLatin spells accented Latin letters in ASCII, and isoLatin with the
+// characters SEPA allows.
+var (
+	asciiLatin = strings.NewReplacer(latinASCII...)
+	isoLatin   = strings.NewReplacer(append(latinASCII, "&", "+")...)
+)
+
+// isoNotCents are the ISO 4217 currencies whose minor unit is not a
+// hundredth.  Amounts are kept in cents, so they cannot be paid in.
+var isoNotCents = map[string]bool{
+	"BIF": true, "CLP": true, "DJF": true, "GNF": true, "ISK": true,
+	"JPY": true, "KMF": true, "KRW": true, "PYG": true, "RWF": true,
+	"UGX": true, "UYI": true, "VND": true, "VUV": true, "XAF": true,
+	"XOF": true, "XPF": true, "BHD": true, "IQD": true, "JOD": true,
+	"KWD": true, "LYD": true, "OMR": true, "TND": true, "CLF": true,
+	"UYW": true,
+}
+
+// centsCurrency reports whether code is an ISO 4217 currency code whose
+// amounts are written with two decimals.
+func centsCurrency(code string) bool {
+	return isoCurrency.MatchString(code) && !isoNotCents[code]
+}
+
+const (
+	isoMax34  = 34
+	isoMax35  = 35
+	isoMax70  = 70
+	isoMax140 = 140
+)
+
+// The pain.001.001.03 elements the export uses, in schema order.
+
+type painDocument struct {
+	XMLName xml.Name       `xml:"Document"`
+	Xmlns   string         `xml:"xmlns,attr"`
+	Init    painInitiation `xml:"CstmrCdtTrfInitn"`
+}
+
+type painInitiation struct {
+	GrpHdr painGroupHeader `xml:"GrpHdr"`
+	PmtInf painPaymentInfo `xml:"PmtInf"`
+}
+
+type painGroupHeader struct {
+	MsgId    string    `xml:"MsgId"`
+	CreDtTm  string    `xml:"CreDtTm"`
+	NbOfTxs  string    `xml:"NbOfTxs"`
+	CtrlSum  string    `xml:"CtrlSum"`
+	InitgPty painParty `xml:"InitgPty"`
+}
+
+type painPaymentInfo struct {
+	PmtInfId    string          `xml:"PmtInfId"`
+	PmtMtd      string          `xml:"PmtMtd"`
+	BtchBookg   bool            `xml:"BtchBookg"`
+	NbOfTxs     string          `xml:"NbOfTxs"`
+	CtrlSum     string          `xml:"CtrlSum"`
+	PmtTpInf    *painPmtTpInf   `xml:"PmtTpInf,omitempty"`
+	ReqdExctnDt string          `xml:"ReqdExctnDt"`
+	Dbtr        painParty       `xml:"Dbtr"`
+	DbtrAcct    painAccount     `xml:"DbtrAcct"`
+	DbtrAgt     painAgent       `xml:"DbtrAgt"`
+	ChrgBr      string          `xml:"ChrgBr"`
+	CdtTrfTxInf []painCreditTfr `xml:"CdtTrfTxInf"`
+}
+
+type painPmtTpInf struct {
+	SvcLvl painCode `xml:"SvcLvl"`
+}
+
+type painCode struct {
+	Cd string `xml:"Cd"`
+}
+
+type painParty struct {
+	Nm string `xml:"Nm"`
+}
+
+type painAccount struct {
+	Id painAccountId `xml:"Id"`
+}
+
+type painAccountId struct {
+	IBAN string    `xml:"IBAN,omitempty"`
+	Othr *painOthr `xml:"Othr,omitempty"`
+}
+
+type painOthr struct {
+	Id string `xml:"Id"`
+}
+
+type painAgent struct {
+	FinInstnId painFinInstn `xml:"FinInstnId"`
+}
+
+type painFinInstn struct {
+	BIC         string         `xml:"BIC,omitempty"`
+	ClrSysMmbId *painClrSysMmb `xml:"ClrSysMmbId,omitempty"`
+}
+
+type painClrSysMmb struct {
+	ClrSysId painCode `xml:"ClrSysId"`
+	MmbId    string   `xml:"MmbId"`
+}
+
+type painCreditTfr struct {
+	PmtId    painPmtId   `xml:"PmtId"`
+	Amt      painAmount  `xml:"Amt"`
+	CdtrAgt  *painAgent  `xml:"CdtrAgt,omitempty"`
+	Cdtr     painParty   `xml:"Cdtr"`
+	CdtrAcct painAccount `xml:"CdtrAcct"`
+	RmtInf   painRmtInf  `xml:"RmtInf"`
+}
+
+type painPmtId struct {
+	EndToEndId string `xml:"EndToEndId"`
+}
+
+type painAmount struct {
+	InstdAmt painInstdAmt `xml:"InstdAmt"`
+}
+
+type painInstdAmt struct {
+	Ccy   string `xml:"Ccy,attr"`
+	Value string `xml:",chardata"`
+}
+
+type painRmtInf struct {
+	Ustrd string `xml:"Ustrd"`
+}
+
+// isoAmount formats an amount in cents as an ISO 20022 decimal amount.
+func isoAmount(cents int64) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// isoTextField cleans s for a text field of at most n characters.
+func isoTextField(s string, n int) string {
+	s = isoText.ReplaceAllString(isoLatin.Replace(s), " ")
+	s = strings.TrimSpace(isoSpaces.ReplaceAllString(s, " "))
+	if len(s) > n {
+		s = s[:n]
+	}
+	return s
+}
+
+// painAccountFor returns the account element of b, by IBAN if it has one.
+func painAccountFor(b BankAccount) painAccount {
+	if b.IBAN != "" {
+		return painAccount{painAccountId{IBAN: b.IBAN}}
+	}
+	return painAccount{painAccountId{Othr: &painOthr{b.AccountNumber}}}
+}
+
+// painAgentFor returns the agent element of the bank of b, by BIC if it
+// has one and otherwise by its ABA routing number.
+func painAgentFor(b BankAccount) painAgent {
+	if b.BIC != "" {
+		return painAgent{painFinInstn{BIC: b.BIC}}
+	}
+	return painAgent{painFinInstn{ClrSysMmbId: &painClrSysMmb{painCode{"USABA"}, b.RoutingNumber}}}
+}
+
+// canTransferFrom reports whether b identifies both an account and its bank
+// well enough for a credit transfer.
+func canTransferFrom(b BankAccount) bool {
+	return (b.IBAN != "" || b.AccountNumber != "") && (b.BIC != "" || b.RoutingNumber != "")
+}
+
+// sepaBatch reports whether every transfer of the batch can go through
+// SEPA: euros between IBAN accounts.
+func sepaBatch(c *Company, batch *PaymentBatch) bool {
+	if batch.Currency != "EUR" || c.Bank.IBAN == "" {
+		return false
+	}
+	for _, e := range batch.Entries {
+		if e.Bank.IBAN == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// GeneratePain001 returns an ISO 20022 pain.001.001.03 credit transfer
+// initiation that pays every entry of batch from the account of company c,
+// with one credit transfer per bill carrying its invoice number.  The
+// message is checked against the schema rules before it is returned.
+func GeneratePain001(c *Company, batch *PaymentBatch, now time.Time) ([]byte, error) {
+	if !c.CanOriginateTransfers() {
+		return nil, fmt.Errorf("company %s has no account for credit transfers", c.Name)
+	}
+
+	var total int64
+	txs := make([]painCreditTfr, 0, len(batch.Entries))
+	for idx, e := range batch.Entries {
+		if !canTransferFrom(e.Bank) {
+			return nil, fmt.Errorf("vendor %s has no bank account", e.VendorName)
+		}
+
+		name := e.Bank.AccountName
+		if name == "" {
+			name = e.VendorName
+		}
+
+		agent := painAgentFor(e.Bank)
+		txs = append(txs, painCreditTfr{
+			PmtId:    painPmtId{isoTextField(batch.Reference+"-"+strconv.Itoa(idx+1), isoMax35)},
+			Amt:      painAmount{painInstdAmt{batch.Currency, isoAmount(int64(e.Amt))}},
+			CdtrAgt:  &agent,
+			Cdtr:     painParty{isoTextField(name, isoMax70)},
+			CdtrAcct: painAccountFor(e.Bank),
+			RmtInf:   painRmtInf{isoTextField("Invoice "+e.InvoiceNum, isoMax140)},
+		})
+		total += int64(e.Amt)
+	}
+
+	count := strconv.Itoa(len(txs))
+	sum := isoAmount(total)
+
+	info := painPaymentInfo{
+		PmtInfId:    isoTextField(batch.Reference, isoMax35),
+		PmtMtd:      "TRF",
+		BtchBookg:   true,
+		NbOfTxs:     count,
+		CtrlSum:     sum,
+		ReqdExctnDt: batch.EffectiveOn.Format("2006-01-02"),
+		Dbtr:        painParty{isoTextField(c.Name, isoMax70)},
+		DbtrAcct:    painAccountFor(c.Bank),
+		DbtrAgt:     painAgentFor(c.Bank),
+		ChrgBr:      "SHAR",
+		CdtTrfTxInf: txs,
+	}
+
+	if sepaBatch(c, batch) {
+		info.PmtTpInf = &painPmtTpInf{painCode{"SEPA"}}
+		info.ChrgBr = "SLEV"
+	}
+
+	doc := painDocument{
+		Xmlns: pain001Namespace,
+		Init: painInitiation{
+			GrpHdr: painGroupHeader{
+				MsgId:    isoTextField(batch.Reference+"-"+now.Format("20060102150405"), isoMax35),
+				CreDtTm:  now.Format("2006-01-02T15:04:05"),
+				NbOfTxs:  count,
+				CtrlSum:  sum,
+				InitgPty: painParty{isoTextField(c.Name, isoMax70)},
+			},
+			PmtInf: info,
+		},
+	}
+
+	err := doc.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), out...), nil
+}
+
+// validate checks the message against the structure of the pain.001.001.03
+// schema: required elements, text lengths, identifier patterns and that the
+// transaction counts and control sums agree.
+func (d *painDocument) validate() error {
+	hdr := d.Init.GrpHdr
+	info := d.Init.PmtInf
+
+	text := func(name, v string, max int) error {
+		if v == "" || len(v) > max {
+			return fmt.Errorf("pain.001 %s must be 1 to %d characters", name, max)
+		}
+		return nil
+	}
+
+	account := func(name string, a painAccount) error {
+		if a.Id.IBAN != "" {
+			if !isoIBAN.MatchString(a.Id.IBAN) {
+				return fmt.Errorf("pain.001 %s IBAN %s is not valid", name, a.Id.IBAN)
+			}
+			return nil
+		}
+		if a.Id.Othr == nil {
+			return fmt.Errorf("pain.001 %s has no account", name)
+		}
+		return text(name+" account", a.Id.Othr.Id, isoMax34)
+	}
+
+	agent := func(name string, a painAgent) error {
+		f := a.FinInstnId
+		if f.BIC != "" {
+			if !isoBIC.MatchString(f.BIC) {
+				return fmt.Errorf("pain.001 %s BIC %s is not valid", name, f.BIC)
+			}
+			return nil
+		}
+		if f.ClrSysMmbId == nil {
+			return fmt.Errorf("pain.001 %s has no bank", name)
+		}
+		return text(name+" clearing member", f.ClrSysMmbId.MmbId, isoMax35)
+	}
+
+	checks := []error{
+		text("MsgId", hdr.MsgId, isoMax35),
+		text("initiating party", hdr.InitgPty.Nm, isoMax140),
+		text("PmtInfId", info.PmtInfId, isoMax35),
+		text("debtor", info.Dbtr.Nm, isoMax140),
+		account("debtor", info.DbtrAcct),
+		agent("debtor agent", info.DbtrAgt),
+	}
+
+	if len(info.CdtTrfTxInf) == 0 {
+		checks = append(checks, fmt.Errorf("pain.001 payment has no transfers"))
+	}
+
+	var total int64
+	for _, tx := range info.CdtTrfTxInf {
+		amt := tx.Amt.InstdAmt
+		checks = append(checks,
+			text("EndToEndId", tx.PmtId.EndToEndId, isoMax35),
+			text("creditor", tx.Cdtr.Nm, isoMax140),
+			account("creditor "+tx.Cdtr.Nm, tx.CdtrAcct),
+			text("remittance information", tx.RmtInf.Ustrd, isoMax140),
+		)
+
+		if tx.CdtrAgt != nil {
+			checks = append(checks, agent("creditor agent", *tx.CdtrAgt))
+		}
+
+		if !centsCurrency(amt.Ccy) {
+			checks = append(checks, fmt.Errorf("pain.001 currency %q is not an ISO 4217 code with two decimals", amt.Ccy))
+		}
+
+		cents, err := parseISOAmount(amt.Value)
+		if err != nil || cents <= 0 {
+			checks = append(checks, fmt.Errorf("pain.001 amount %q must be positive", amt.Value))
+		}
+		total += cents
+	}
+
+	n := strconv.Itoa(len(info.CdtTrfTxInf))
+	if hdr.NbOfTxs != n || info.NbOfTxs != n {
+		checks = append(checks, fmt.Errorf("pain.001 number of transactions does not match"))
+	}
+
+	if hdr.CtrlSum != isoAmount(total) || info.CtrlSum != isoAmount(total) {
+		checks = append(checks, fmt.Errorf("pain.001 control sum does not match"))
+	}
+
+	for _, err := range checks {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseISOAmount returns the amount in cents of an ISO 20022 decimal amount
+// with two fraction digits.
+func parseISOAmount(s string) (int64, error) {
+	var units, cents int64
+	_, err := fmt.Sscanf(s, "%d.%02d", &units, &cents)
+	return units*100 + cents, err
+}
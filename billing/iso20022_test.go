@@ -0,0 +1,159 @@
+package billing
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestISOAmount(t *testing.T) {
+	tests := []struct {
+		cents int64
+		s     string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{100, "1.00"},
+		{123456, "1234.56"},
+		{9999999999, "99999999.99"},
+	}
+
+	for _, tt := range tests {
+		if got := isoAmount(tt.cents); got != tt.s {
+			t.Errorf("isoAmount(%d) = %q, want %q", tt.cents, got, tt.s)
+		}
+
+		cents, err := parseISOAmount(tt.s)
+		if err != nil || cents != tt.cents {
+			t.Errorf("parseISOAmount(%q) = %d, %v, want %d", tt.s, cents, err, tt.cents)
+		}
+	}
+}
+
+func TestGeneratePain001(t *testing.T) {
+	c := &Company{
+		Name: "Example Holdings",
+		Bank: BankAccount{IBAN: "DE89370400440532013000", BIC: "COBADEFFXXX"},
+	}
+
+	sepa := BankAccount{IBAN: "FR1420041010050500013M02606", BIC: "BNPAFRPP"}
+	us := BankAccount{RoutingNumber: "021000021", AccountNumber: "12345678"}
+
+	tests := []struct {
+		currency string
+		banks    []BankAccount
+		amts     []int
+		count    string
+		sum      string
+		sepa     bool
+	}{
+		{"EUR", []BankAccount{sepa}, []int{12345}, "1", "123.45", true},
+		{"EUR", []BankAccount{sepa, sepa, sepa}, []int{1, 10, 100000}, "3", "1000.11", true},
+		{"EUR", []BankAccount{sepa, us}, []int{50, 50}, "2", "1.00", false},
+		{"USD", []BankAccount{sepa}, []int{99999999}, "1", "999999.99", false},
+	}
+
+	for _, tt := range tests {
+		pb := &PaymentBatch{
+			Method:      PaymentMethodWire,
+			Currency:    tt.currency,
+			Reference:   "WIRE7",
+			EffectiveOn: time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC),
+		}
+		for i, b := range tt.banks {
+			pb.Entries = append(pb.Entries, BatchEntry{VendorName: "Fournisseur Sàrl", InvoiceNum: "F-1", Amt: tt.amts[i], Bank: b})
+		}
+
+		out, err := GeneratePain001(c, pb, time.Date(2026, 3, 3, 14, 5, 0, 0, time.UTC))
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.currency, tt.amts, err)
+			continue
+		}
+
+		doc := new(painDocument)
+		err = xml.Unmarshal(out, doc)
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.currency, tt.amts, err)
+			continue
+		}
+
+		hdr, info := doc.Init.GrpHdr, doc.Init.PmtInf
+		if hdr.NbOfTxs != tt.count || info.NbOfTxs != tt.count {
+			t.Errorf("%s %v: %s and %s transactions, want %s", tt.currency, tt.amts, hdr.NbOfTxs, info.NbOfTxs, tt.count)
+		}
+		if hdr.CtrlSum != tt.sum || info.CtrlSum != tt.sum {
+			t.Errorf("%s %v: control sums %s and %s, want %s", tt.currency, tt.amts, hdr.CtrlSum, info.CtrlSum, tt.sum)
+		}
+		if (info.PmtTpInf != nil) != tt.sepa {
+			t.Errorf("%s %v: SEPA %v, want %v", tt.currency, tt.amts, info.PmtTpInf != nil, tt.sepa)
+		}
+
+		for _, tx := range info.CdtTrfTxInf {
+			if tx.Amt.InstdAmt.Ccy != tt.currency {
+				t.Errorf("%s %v: transfer in %s", tt.currency, tt.amts, tx.Amt.InstdAmt.Ccy)
+			}
+			if tx.Cdtr.Nm != "Fournisseur Sarl" {
+				t.Errorf("%s %v: creditor %q", tt.currency, tt.amts, tx.Cdtr.Nm)
+			}
+		}
+
+		// A message whose control sum disagrees with its transfers fails.
+		doc.Init.GrpHdr.CtrlSum = "0.01"
+		if doc.validate() == nil {
+			t.Errorf("%s %v: wrong control sum passed validation", tt.currency, tt.amts)
+		}
+	}
+}
+
+func TestCentsCurrency(t *testing.T) {
+	tests := []struct {
+		code  string
+		valid bool
+	}{
+		{"EUR", true},
+		{"USD", true},
+		{"CHF", true},
+		{"JPY", false},
+		{"KWD", false},
+		{"eur", false},
+		{"EURO", false},
+	}
+
+	for _, tt := range tests {
+		if got := centsCurrency(tt.code); got != tt.valid {
+			t.Errorf("centsCurrency(%q) = %v, want %v", tt.code, got, tt.valid)
+		}
+	}
+}
+
+func TestGeneratePain001Invalid(t *testing.T) {
+	c := &Company{
+		Name: "Example Holdings",
+		Bank: BankAccount{IBAN: "DE89370400440532013000", BIC: "COBADEFFXXX"},
+	}
+
+	tests := []struct {
+		name     string
+		currency string
+		bank     BankAccount
+	}{
+		{"no cents", "JPY", BankAccount{IBAN: "FR1420041010050500013M02606", BIC: "BNPAFRPP"}},
+		{"long account", "USD", BankAccount{RoutingNumber: "021000021", AccountNumber: strings.Repeat("1", 35)}},
+	}
+
+	for _, tt := range tests {
+		pb := &PaymentBatch{
+			Method:      PaymentMethodWire,
+			Currency:    tt.currency,
+			Reference:   "WIRE7",
+			EffectiveOn: time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC),
+			Entries:     []BatchEntry{{VendorName: "Vendor", InvoiceNum: "1", Amt: 100, Bank: tt.bank}},
+		}
+
+		_, err := GeneratePain001(c, pb, time.Date(2026, 3, 3, 14, 5, 0, 0, time.UTC))
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
 	"time"
 
 	"appengine"
@@ -43,48 +44,146 @@ func authOnly(next myHandler) myHandler {
 	}
 }
 
-func handleRoot(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	uploadURL, err := blobstore.UploadURL(ctx.c, "/upload", nil)
+type UploadForm struct {
+	Bill           *Bill
+	ValidationErrs []string
+	UploadURL      *url.URL
+}
+
+func renderUploadForm(ctx *Context, b *Bill, errs []string) error {
+	uploadURL, err := blobstore.UploadURL(ctx.c, "/bills/upload", nil)
 	if err != nil {
 		return err
 	}
 
 	ctx.SetTitle("Upload New Bill")
 
-	render := struct {
-		UploadURL *url.URL
-	}{uploadURL}
-	return ctx.Render(uploadTmpl, render)
+	return ctx.Render(uploadTmpl, UploadForm{b, errs, uploadURL})
+}
+
+func handleRoot(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	return renderUploadForm(ctx, &Bill{}, []string{})
 }
 
 func handleView(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	s := r.FormValue("id")
-	key, err := datastore.DecodeKey(s)
+	bill, err := ctx.GetAuthorizedBill(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	p := &Payment{
+		Amt:    bill.AmountDue(),
+		PaidOn: time.Now(),
+	}
+
+	return renderBillView(ctx, bill, p, []string{})
+}
+
+type BillView struct {
+	Bill           *Bill
+	Events         []*BillEvent
+	Payments       []*Payment
+	Payment        *Payment
+	Methods        []PaymentMethod
+	ValidationErrs []string
+	UploadURL      *url.URL
+	Perms          map[string]bool
+}
+
+func renderBillView(ctx *Context, b *Bill, p *Payment, errs []string) error {
+	uploadURL, err := blobstore.UploadURL(ctx.c, "/bills/pay", nil)
+	if err != nil {
+		return err
+	}
 
+	events, err := ctx.GetBillEvents(b)
 	if err != nil {
-		return fmt.Errorf("Invalid key after decoding: %s", err.Error())
+		return err
 	}
 
-	bill := new(Bill)
+	payments, err := ctx.GetBillPayments(b)
+	if err != nil {
+		return err
+	}
 
-	err = datastore.Get(ctx.c, key, bill)
+	ctx.SetTitle("View Bill")
 
+	return ctx.Render(viewTmpl, BillView{b, events, payments, p, paymentMethods, errs, uploadURL, ctx.Permissions()})
+}
+
+func handleBillPay(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	blobs, fields, err := blobstore.ParseUpload(ctx.r)
 	if err != nil {
-		if err == datastore.ErrNoSuchEntity {
-			return ctx.NotFound()
-		} else {
-			return fmt.Errorf("Error on database get: %s", err.Error())
-		}
+		return err
+	}
+
+	p := newPaymentFromUpload(blobs, fields)
+	id := getFormFieldString(fields, "id")
 
+	b, err := ctx.GetAuthorizedBill(id)
+	if err != nil {
+		ctx.discardProof(p)
+		return err
 	}
 
-	ctx.Render(viewTmpl, bill)
-	return nil
+	errs := p.Validate()
+	if len(errs) > 0 {
+		ctx.discardProof(p)
+		p.ProofBlobKey = ""
+		return renderBillView(ctx, b, p, errs)
+	}
+
+	_, err = ctx.PayBill(b.Key, p, getFormFieldString(fields, "justification"))
+	if serr, ok := err.(BillStatusError); ok {
+		ctx.discardProof(p)
+		ctx.Flash("%s", serr.Error())
+		return ctx.Redirect("/bills/view?id=" + id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("%s", billActionMessages[BillActionPay])
+	return ctx.Redirect("/bills/view?id=" + id)
+}
+
+func handleBillStatus(action string) myHandler {
+	return func(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+		id := r.FormValue("id")
+		if r.Method != "POST" {
+			return ctx.Redirect("/bills/view?id=" + id)
+		}
+
+		b, err := ctx.GetAuthorizedBill(id)
+		if err != nil {
+			return err
+		}
+
+		_, err = ctx.UpdateBillStatus(b.Key, action, r.FormValue("reason"), r.FormValue("justification"))
+		if serr, ok := err.(BillStatusError); ok {
+			ctx.Flash("%s", serr.Error())
+			return ctx.Redirect("/bills/view?id=" + id)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		ctx.Flash("%s", billActionMessages[action])
+		return ctx.Redirect("/bills/view?id=" + id)
+	}
 }
 
 func handleDownload(ctx *Context, w http.ResponseWriter, r *http.Request) error {
 
 	blobKey := appengine.BlobKey(r.FormValue("id"))
+
+	_, err := ctx.GetAuthorizedBlobBill(blobKey)
+	if err != nil {
+		return err
+	}
+
 	stat, err := blobstore.Stat(ctx.c, blobKey)
 
 	if err == datastore.ErrNoSuchEntity {
@@ -111,37 +210,111 @@ func handleUpload(ctx *Context, w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	//vendor := getFormFieldString(fields, "vendor")
-	amt := getFormFieldInt(fields, "amount")
+	b := newBillFromUpload(blobs, fields)
+	if b.DueOn.IsZero() {
+		b.DueOn = b.Date
+	}
 
-	file := blobs["file"]
-	if len(file) == 0 {
+	if b.BlobKey == "" {
 		ctx.c.Errorf("no file uploaded")
 		http.Redirect(w, r, "/", http.StatusFound)
 		return nil
 	}
 
-	b := Bill{
-		Amt:      amt,
-		PostedOn: time.Now(),
-		PostedBy: ctx.user.String(),
-		BlobKey:  file[0].BlobKey,
+	errs := b.ValidateInvoice()
+	if b.Amt <= 0 {
+		errs = append(errs, "Amount must be greater than 0")
+	}
+
+	if len(errs) > 0 {
+		ctx.discardUpload(b)
+		return renderUploadForm(ctx, b, errs)
 	}
 
-	key := datastore.NewIncompleteKey(ctx.c, "Bill", nil)
-	billKey, err := datastore.Put(ctx.c, key, &b)
+	companyKey := ctx.userSession.Company.Key
+
+	b.PostedOn = time.Now()
+	b.PostedBy = ctx.user.String()
+	b.CompanyKey = companyKey
+	b.startApproval(ctx.userSession.Company)
+
+	key := datastore.NewIncompleteKey(ctx.c, "Bill", companyKey)
+	billKey, err := ctx.putAudited(key, nil, b)
 
 	if err != nil {
 		return err
 	}
 
-	http.Redirect(w, r, "/view/?id="+billKey.Encode(), http.StatusFound)
+	http.Redirect(w, r, "/bills/view?id="+billKey.Encode(), http.StatusFound)
 
 	return nil
 }
 
+// upcomingBills is how many of the next bills due are listed on the
+// company dashboard.
+const upcomingBills = 5
+
+type BillsDashboard struct {
+	Company         *Company
+	Unpaid          []*Bill
+	UnpaidTotal     int
+	Paid            []*Bill
+	PaidTotal       int
+	Upcoming        []*Bill
+	Reconciled      []*Bill
+	ReconciledPager *Pager
+	Perms           map[string]bool
+}
+
 func handleBillsDashboard(ctx *Context, w http.ResponseWriter, r *http.Request) error {
-	return ctx.Render(billsDashTmpl, "Hello Bills")
+	company := ctx.userSession.Company
+	d := BillsDashboard{Company: company, Perms: ctx.Permissions()}
+
+	// Open bills are shown in full so the totals cover all of them;
+	// reconciled bills are paged.
+	open, err := ctx.GetCompanyUnreconciledBills(company, nil)
+	if err != nil {
+		return err
+	}
+
+	d.ReconciledPager = NewPager(r.URL.Query(), "reconciled_", 20)
+	d.Reconciled, err = ctx.GetCompanyReconciledBills(company, d.ReconciledPager)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.LoadBillVendors(open)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.LoadBillVendors(d.Reconciled)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range open {
+		if b.Paid {
+			d.Paid = append(d.Paid, b)
+			d.PaidTotal += b.PaidAmt
+			continue
+		}
+
+		d.Unpaid = append(d.Unpaid, b)
+		d.UnpaidTotal += b.Balance()
+		if !b.DueOn.IsZero() {
+			d.Upcoming = append(d.Upcoming, b)
+		}
+	}
+
+	sort.Sort(billsByDue(d.Upcoming))
+	if len(d.Upcoming) > upcomingBills {
+		d.Upcoming = d.Upcoming[:upcomingBills]
+	}
+
+	ctx.SetTitle(company.Name + " Bills")
+
+	return ctx.Render(billsDashTmpl, d)
 }
 
 var (
@@ -149,20 +322,32 @@ var (
 	uploadTmpl    = tmpl("upload.html")
 	viewTmpl      = tmpl("view.html")
 	billsDashTmpl = tmpl("bills/dashboard.html")
+	usersTmpl     = tmpl("bills/users.html")
+	approvalsTmpl = tmpl("bills/approvals.html")
 )
 
 func init() {
 	r := mux.NewRouter()
 
-	r.Handle("/", authOnly(handleRoot))
+	r.Handle("/", permissionOnly(PermSubmitBills, handleRoot))
 
 	setupAdminRoutes(r)
 	setupLoginRoutes(r)
 
-	r.Handle("/bills/dashboard", authOnly(handleBillsDashboard))
-	r.Handle("/bills/view", authOnly(handleView))
-	r.Handle("/bills/upload", authOnly(handleUpload))
-	r.Handle("/bills/download/", authOnly(handleDownload))
+	r.Handle("/bills/dashboard", permissionOnly(PermViewBills, handleBillsDashboard))
+	r.Handle("/bills/view", permissionOnly(PermViewBills, handleView))
+	r.Handle("/bills/upload", permissionOnly(PermSubmitBills, handleUpload))
+	r.Handle("/bills/download/", permissionOnly(PermViewBills, handleDownload))
+	r.Handle("/bills/approvals", permissionOnly(PermApproveBills, handleApprovals))
+	r.Handle("/bills/approve", permissionOnly(PermApproveBills, handleBillStatus(BillActionApprove)))
+	r.Handle("/bills/reject", permissionOnly(PermApproveBills, handleBillStatus(BillActionReject)))
+	r.Handle("/bills/resubmit", permissionOnly(PermSubmitBills, handleBillStatus(BillActionResubmit)))
+	r.Handle("/bills/pay", permissionOnly(PermPayBills, handleBillPay))
+	r.Handle("/bills/reconcile", permissionOnly(PermReconcileBills, handleBillStatus(BillActionReconcile)))
+	r.Handle("/bills/unpay", permissionOnly(PermPayBills, handleBillStatus(BillActionUnpay)))
+	r.Handle("/bills/unreconcile", permissionOnly(PermReconcileBills, handleBillStatus(BillActionUnreconcile)))
+	r.Handle("/bills/users", permissionOnly(PermManageUsers, handleCompanyUsers))
+	r.Handle("/bills/user/roles", permissionOnly(PermManageUsers, handleCompanyUserRoles))
 
 	http.Handle("/", r)
 }
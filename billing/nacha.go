@@ -0,0 +1,197 @@
+package billing
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NACHA file layout constants.  Every record is 94 characters and the file
+// is padded with records of nines to a multiple of the blocking factor.
+const (
+	nachaRecordSize     = 94
+	nachaBlockingFactor = 10
+
+	// nachaCreditsOnly is the service class code of a batch of credits.
+	nachaCreditsOnly = "220"
+)
+
+// ACH standard entry class codes.  CCD pays businesses, PPD pays people.
+const (
+	SECCorporate = "CCD"
+	SECPersonal  = "PPD"
+)
+
+// nachaTransactionCode returns the entry transaction code of a credit to an
+// account of the given type.
+func nachaTransactionCode(accountType string) string {
+	if accountType == AccountSavings {
+		return "32"
+	}
+	return "22"
+}
+
+// nachaAlpha formats s as an alphanumeric field of width n: upper case,
+// left justified and padded with spaces.  Characters the format does not
+// allow are replaced with spaces.
+func nachaAlpha(s string, n int) string {
+	b := make([]byte, 0, n)
+	for _, c := range strings.ToUpper(s) {
+		if len(b) == n {
+			break
+		}
+		if c < ' ' || c > '~' {
+			c = ' '
+		}
+		b = append(b, byte(c))
+	}
+	for len(b) < n {
+		b = append(b, ' ')
+	}
+	return string(b)
+}
+
+// nachaNum formats v as a numeric field of width n: right justified and
+// padded with zeros.  Only the last n digits are kept, as hash totals
+// require.
+func nachaNum(v int64, n int) string {
+	s := strconv.FormatInt(v, 10)
+	if len(s) > n {
+		return s[len(s)-n:]
+	}
+	return strings.Repeat("0", n-len(s)) + s
+}
+
+// nachaWriter builds a NACHA file one record at a time.
+type nachaWriter struct {
+	buf     bytes.Buffer
+	records int
+	err     error
+}
+
+func (w *nachaWriter) record(fields ...string) {
+	r := strings.Join(fields, "")
+	if len(r) != nachaRecordSize && w.err == nil {
+		w.err = fmt.Errorf("NACHA record %q is %d characters, not %d", r[:1], len(r), nachaRecordSize)
+	}
+	w.buf.WriteString(r)
+	w.buf.WriteString("\n")
+	w.records++
+}
+
+// GenerateNACHA returns a NACHA file that credits every entry of batch to
+// the vendor's account, from the account of company c.  Each entry carries
+// an addenda record with the invoice number.
+func GenerateNACHA(c *Company, batch *PaymentBatch, now time.Time) ([]byte, error) {
+	if !c.CanOriginateACH() {
+		return nil, fmt.Errorf("company %s has no ACH details", c.Name)
+	}
+	if !validABARouting(c.Bank.RoutingNumber) {
+		return nil, fmt.Errorf("company %s has an invalid routing number", c.Name)
+	}
+
+	odfi := c.Bank.RoutingNumber[:8]
+	batchNum := nachaNum(1, 7)
+	w := &nachaWriter{}
+
+	// File header.
+	w.record(
+		"1", "01",
+		" "+c.Bank.RoutingNumber,
+		nachaAlpha(c.ACHCompanyID, 10),
+		now.Format("060102"), now.Format("1504"),
+		"A", "094", nachaNum(nachaBlockingFactor, 2), "1",
+		nachaAlpha(c.Bank.BankName, 23),
+		nachaAlpha(c.Name, 23),
+		nachaAlpha(batch.Reference, 8),
+	)
+
+	// Batch header.
+	w.record(
+		"5", nachaCreditsOnly,
+		nachaAlpha(c.Name, 16),
+		nachaAlpha(batch.Reference, 20),
+		nachaAlpha(c.ACHCompanyID, 10),
+		batch.SEC,
+		nachaAlpha("PAYMENT", 10),
+		nachaAlpha(now.Format("060102"), 6),
+		batch.EffectiveOn.Format("060102"),
+		"   ", "1",
+		odfi, batchNum,
+	)
+
+	var hash, total int64
+	entries := 0
+	for idx, e := range batch.Entries {
+		if e.Bank.RoutingNumber == "" || e.Bank.AccountNumber == "" {
+			return nil, fmt.Errorf("vendor %s has no bank account", e.VendorName)
+		}
+		if !validABARouting(e.Bank.RoutingNumber) {
+			return nil, fmt.Errorf("vendor %s has an invalid routing number", e.VendorName)
+		}
+
+		seq := int64(idx + 1)
+		rdfi, _ := strconv.ParseInt(e.Bank.RoutingNumber[:8], 10, 64)
+		hash += rdfi
+		total += int64(e.Amt)
+
+		name := e.Bank.AccountName
+		if name == "" {
+			name = e.VendorName
+		}
+
+		// Entry detail.
+		w.record(
+			"6", nachaTransactionCode(e.Bank.AccountType),
+			e.Bank.RoutingNumber[:8], e.Bank.RoutingNumber[8:],
+			nachaAlpha(e.Bank.AccountNumber, 17),
+			nachaNum(int64(e.Amt), 10),
+			nachaAlpha(e.InvoiceNum, 15),
+			nachaAlpha(name, 22),
+			"  ", "1",
+			odfi, nachaNum(seq, 7),
+		)
+
+		// Addenda with an X12 remittance segment for the invoice paid.
+		w.record(
+			"7", "05",
+			nachaAlpha(fmt.Sprintf("RMR*IV*%s**%d.%02d\\", e.InvoiceNum, e.Amt/100, e.Amt%100), 80),
+			nachaNum(1, 4),
+			nachaNum(seq, 7),
+		)
+		entries += 2
+	}
+
+	// Batch control.
+	w.record(
+		"8", nachaCreditsOnly,
+		nachaNum(int64(entries), 6),
+		nachaNum(hash, 10),
+		nachaNum(0, 12),
+		nachaNum(total, 12),
+		nachaAlpha(c.ACHCompanyID, 10),
+		nachaAlpha("", 19), nachaAlpha("", 6),
+		odfi, batchNum,
+	)
+
+	// File control.  The block count includes this record.
+	blocks := (w.records + 1 + nachaBlockingFactor - 1) / nachaBlockingFactor
+	w.record(
+		"9",
+		nachaNum(1, 6),
+		nachaNum(int64(blocks), 6),
+		nachaNum(int64(entries), 8),
+		nachaNum(hash, 10),
+		nachaNum(0, 12),
+		nachaNum(total, 12),
+		nachaAlpha("", 39),
+	)
+
+	for w.records%nachaBlockingFactor != 0 {
+		w.record(strings.Repeat("9", nachaRecordSize))
+	}
+
+	return w.buf.Bytes(), w.err
+}
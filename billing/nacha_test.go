@@ -0,0 +1,145 @@
+package billing
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNachaFields(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{nachaNum(42, 6), "000042"},
+		{nachaNum(1234567890123, 10), "4567890123"},
+		{nachaNum(0, 3), "000"},
+		{nachaAlpha("Acme, Inc.", 12), "ACME, INC.  "},
+		{nachaAlpha("Société", 8), "SOCI T  "},
+		{nachaAlpha("a longer name", 4), "A LO"},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+// nachaTestBatch returns an ACH batch paying n entries, each to the bank
+// with routing number routing.
+func nachaTestBatch(n int, routing string, amt int) *PaymentBatch {
+	pb := &PaymentBatch{
+		Method:      PaymentMethodACH,
+		SEC:         SECCorporate,
+		Reference:   "ACH42",
+		EffectiveOn: time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC),
+	}
+	for i := 0; i < n; i++ {
+		pb.Entries = append(pb.Entries, BatchEntry{
+			VendorName: "Vendor " + strconv.Itoa(i),
+			InvoiceNum: "INV-" + strconv.Itoa(i),
+			Amt:        amt,
+			Bank:       BankAccount{RoutingNumber: routing, AccountNumber: "12345678", AccountType: AccountChecking},
+		})
+		pb.Total += amt
+	}
+	return pb
+}
+
+func TestGenerateNACHA(t *testing.T) {
+	c := &Company{
+		Name:         "Example Holdings",
+		Bank:         BankAccount{BankName: "First Bank", RoutingNumber: "011000015", AccountNumber: "99887766"},
+		ACHCompanyID: "1234567890",
+	}
+
+	tests := []struct {
+		entries int
+		routing string
+		amt     int
+		hash    string
+		total   string
+	}{
+		{1, "021000021", 12345, "0002100002", "000000012345"},
+		{3, "021000021", 100, "0006300006", "000000000300"},
+		{2, "121000358", 9999999999, "0024200070", "019999999998"},
+		// Hash totals keep only their last ten digits.
+		{1000, "121000358", 1, "2100035000", "000000001000"},
+	}
+
+	for _, tt := range tests {
+		pb := nachaTestBatch(tt.entries, tt.routing, tt.amt)
+		file, err := GenerateNACHA(c, pb, time.Date(2026, 3, 3, 14, 5, 0, 0, time.UTC))
+		if err != nil {
+			t.Errorf("%d entries: %v", tt.entries, err)
+			continue
+		}
+
+		lines := strings.Split(strings.TrimSuffix(string(file), "\n"), "\n")
+		if len(lines)%nachaBlockingFactor != 0 {
+			t.Errorf("%d entries: %d records, not a multiple of %d", tt.entries, len(lines), nachaBlockingFactor)
+		}
+
+		counts := map[byte]int{}
+		for i, l := range lines {
+			if len(l) != nachaRecordSize {
+				t.Errorf("%d entries: record %d is %d characters", tt.entries, i+1, len(l))
+			}
+			counts[l[0]]++
+		}
+
+		if counts['6'] != tt.entries || counts['7'] != tt.entries {
+			t.Errorf("%d entries: %d entry and %d addenda records", tt.entries, counts['6'], counts['7'])
+		}
+
+		// The batch and file control records follow the last addenda.
+		last := 2 + 2*tt.entries
+		batchControl, fileControl := lines[last], lines[last+1]
+		if batchControl[0] != '8' || fileControl[0] != '9' {
+			t.Fatalf("%d entries: control records out of place", tt.entries)
+		}
+
+		if got := batchControl[10:20]; got != tt.hash {
+			t.Errorf("%d entries: batch hash %s, want %s", tt.entries, got, tt.hash)
+		}
+		if got := fileControl[21:31]; got != tt.hash {
+			t.Errorf("%d entries: file hash %s, want %s", tt.entries, got, tt.hash)
+		}
+		if got := batchControl[32:44]; got != tt.total {
+			t.Errorf("%d entries: batch credit total %s, want %s", tt.entries, got, tt.total)
+		}
+		if got := fileControl[43:55]; got != tt.total {
+			t.Errorf("%d entries: file credit total %s, want %s", tt.entries, got, tt.total)
+		}
+
+		blocks, _ := strconv.Atoi(fileControl[7:13])
+		if blocks != len(lines)/nachaBlockingFactor {
+			t.Errorf("%d entries: block count %d for %d records", tt.entries, blocks, len(lines))
+		}
+	}
+}
+
+func TestGenerateNACHARouting(t *testing.T) {
+	tests := []struct {
+		company, vendor string
+	}{
+		{"0110", "021000021"},
+		{"011000016", "021000021"},
+		{"011000015", "0210"},
+		{"011000015", "021000022"},
+	}
+
+	for _, tt := range tests {
+		c := &Company{
+			Name:         "Example Holdings",
+			Bank:         BankAccount{RoutingNumber: tt.company, AccountNumber: "99887766"},
+			ACHCompanyID: "1234567890",
+		}
+
+		_, err := GenerateNACHA(c, nachaTestBatch(1, tt.vendor, 100), time.Now())
+		if err == nil {
+			t.Errorf("routing numbers %s and %s: no error", tt.company, tt.vendor)
+		}
+	}
+}
@@ -0,0 +1,653 @@
+package billing
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+	"appengine/taskqueue"
+	"appengine/user"
+)
+
+// Offboarding states.  An offboarding first exports the company data, then
+// moves the company and everything under it to the trash.
+const (
+	OffboardExporting = "exporting"
+	OffboardArchiving = "archiving"
+	OffboardDone      = "done"
+)
+
+// offboardBatchSize is how many entities each archiving task moves to the
+// trash, so that every task finishes well within its deadline.
+const offboardBatchSize = 50
+
+// auditExportBatchSize is how many audit events each part of an export
+// holds.  Audit events are small, so a part can hold many more of them than
+// of bills.
+const auditExportBatchSize = 500
+
+// offboardKinds are archived in this order before the company itself.
+var offboardKinds = []string{"Bill", "Vendor", "User"}
+
+const offboardTaskPath = "/tasks/offboard"
+
+// Offboarding tracks the removal of a company that has left.  There is one
+// per company, stored as its child.  The work is done by a chain of tasks,
+// each of which handles one step and queues the next.
+//
+// ExportParts are the zip files of the export, written one batch at a time.
+// Kind is the kind being exported or archived and Cursor where its next
+// batch starts.  Error holds the last error
+// of a failed task, which the queue retries.
+type Offboarding struct {
+	Key         *datastore.Key `datastore:"-"`
+	State       string
+	StartedBy   string
+	StartedOn   time.Time
+	FinishedOn  time.Time
+	ExportParts []appengine.BlobKey
+	Kind        string
+	Cursor      string `datastore:",noindex"`
+	Total       int
+	Archived    int
+	Error       string `datastore:",noindex"`
+}
+
+func offboardingKey(c appengine.Context, companyKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "Offboarding", "offboarding", 0, companyKey)
+}
+
+func (o *Offboarding) Running() bool {
+	return o.State == OffboardExporting || o.State == OffboardArchiving
+}
+
+// PartNumbers numbers the parts of the export from 1, as they are named
+// in the download links.
+func (o *Offboarding) PartNumbers() []int {
+	nums := make([]int, len(o.ExportParts))
+	for idx := range nums {
+		nums[idx] = idx + 1
+	}
+	return nums
+}
+
+// Percent is how much of the archiving is done.
+func (o *Offboarding) Percent() int {
+	switch {
+	case o.State == OffboardDone:
+		return 100
+	case o.Total == 0:
+		return 0
+	case o.Archived >= o.Total:
+		return 100
+	}
+	return o.Archived * 100 / o.Total
+}
+
+// GetOffboarding returns the offboarding of the company at companyKey, or
+// nil if it has not been started.
+func (ctx *Context) GetOffboarding(companyKey *datastore.Key) (*Offboarding, error) {
+	o := new(Offboarding)
+	k := offboardingKey(ctx.c, companyKey)
+	err := datastore.Get(ctx.c, k, o)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+
+	o.Key = k
+	return o, err
+}
+
+func queueOffboardTask(c appengine.Context, companyKey *datastore.Key) error {
+	t := taskqueue.NewPOSTTask(offboardTaskPath, url.Values{"id": {companyKey.Encode()}})
+	_, err := taskqueue.Add(c, t, "")
+	return err
+}
+
+// StartOffboarding starts the offboarding of the company at key.  The
+// company must not be in the trash or being offboarded, and must have no
+// open payment batches.  A company that was restored after an offboarding
+// can be offboarded again.
+func (ctx *Context) StartOffboarding(key *datastore.Key) error {
+	return datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		company := new(Company)
+		err := datastore.Get(c, key, company)
+		if err != nil {
+			return err
+		}
+
+		if company.Deleted {
+			return InUseError("The company is already in the trash.")
+		}
+
+		k := offboardingKey(c, key)
+		prev := new(Offboarding)
+		err = datastore.Get(c, k, prev)
+		if err == nil && prev.Running() {
+			return InUseError("The company is already being offboarded.")
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		batches, err := datastore.NewQuery("PaymentBatch").Ancestor(key).Filter("State =", BatchGenerated).KeysOnly().Limit(1).GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		if len(batches) > 0 {
+			return InUseError("The company has open payment batches. Confirm or cancel them first.")
+		}
+
+		o := Offboarding{
+			State:     OffboardExporting,
+			StartedBy: ctx.user.String(),
+			StartedOn: time.Now(),
+		}
+		_, err = datastore.Put(c, k, &o)
+		if err != nil {
+			return err
+		}
+
+		return queueOffboardTask(c, key)
+	}, nil)
+}
+
+// companyExport is the data file of the first part of a company export.
+// The audit log and then the bills follow in the later parts.
+type companyExport struct {
+	Company *Company
+	Users   []*User
+	Vendors []*Vendor
+}
+
+type billExport struct {
+	*Bill
+	Events   []*BillEvent
+	Payments []*Payment
+}
+
+// copyBlob adds the blob at blobKey to z under the files directory.
+func (ctx *Context) copyBlob(z *zip.Writer, blobKey appengine.BlobKey) error {
+	stat, err := blobstore.Stat(ctx.c, blobKey)
+	if err == datastore.ErrNoSuchEntity {
+		ctx.c.Errorf("file %s is missing from the export", blobKey)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := z.Create(fmt.Sprintf("files/%s/%s", blobKey, stat.Filename))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, blobstore.NewReader(ctx.c, blobKey))
+	return err
+}
+
+// writeExportPart stores a zip file holding v as JSON under name, together
+// with the files at blobKeys, and returns the blob it was stored in.
+func (ctx *Context) writeExportPart(name string, v interface{}, blobKeys []appengine.BlobKey) (appengine.BlobKey, error) {
+	w, err := blobstore.Create(ctx.c, "application/zip")
+	if err != nil {
+		return "", err
+	}
+
+	z := zip.NewWriter(w)
+	f, err := z.Create(name)
+	if err != nil {
+		return "", err
+	}
+
+	err = json.NewEncoder(f).Encode(v)
+	if err != nil {
+		return "", err
+	}
+
+	for _, k := range blobKeys {
+		err = ctx.copyBlob(z, k)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = z.Close()
+	if err != nil {
+		return "", err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return w.Key()
+}
+
+// exportCompanyData writes the first part of the export of the company at
+// key: the company itself, its users and vendors, including those in the
+// trash.  It counts the users and vendors not yet in the trash in o.Total.
+func (ctx *Context) exportCompanyData(key *datastore.Key, o *Offboarding) error {
+	e := &companyExport{Company: new(Company)}
+	err := datastore.Get(ctx.c, key, e.Company)
+	if err != nil {
+		return err
+	}
+
+	_, err = datastore.NewQuery("User").Ancestor(key).GetAll(ctx.c, &e.Users)
+	if err != nil {
+		return err
+	}
+
+	_, err = datastore.NewQuery("Vendor").Ancestor(key).GetAll(ctx.c, &e.Vendors)
+	if err != nil {
+		return err
+	}
+
+	part, err := ctx.writeExportPart("company.json", e, nil)
+	if err != nil {
+		return err
+	}
+
+	o.Total = 0
+	for _, u := range e.Users {
+		if notDeleted(u) {
+			o.Total++
+		}
+	}
+	for _, v := range e.Vendors {
+		if notDeleted(v) {
+			o.Total++
+		}
+	}
+
+	o.ExportParts = append(o.ExportParts, part)
+	o.Kind = "AuditEvent"
+	o.Cursor = ""
+	return nil
+}
+
+// exportAuditEvents writes the next batch of the audit log of the company
+// at key as a part of its export and advances o.  After the last batch o
+// moves on to the bills.
+func (ctx *Context) exportAuditEvents(key *datastore.Key, o *Offboarding) error {
+	q := datastore.NewQuery("AuditEvent").Ancestor(key).Limit(auditExportBatchSize)
+	if o.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(o.Cursor)
+		if err != nil {
+			return err
+		}
+		q = q.Start(cursor)
+	}
+
+	t := q.Run(ctx.c)
+	events := []*AuditEvent{}
+	for {
+		e := new(AuditEvent)
+		_, err := t.Next(e)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		events = append(events, e)
+	}
+
+	if len(events) > 0 {
+		part, err := ctx.writeExportPart("audit.json", events, nil)
+		if err != nil {
+			return err
+		}
+
+		o.ExportParts = append(o.ExportParts, part)
+	}
+
+	if len(events) < auditExportBatchSize {
+		o.Kind = "Bill"
+		o.Cursor = ""
+		return nil
+	}
+
+	cursor, err := t.Cursor()
+	if err != nil {
+		return err
+	}
+
+	o.Cursor = cursor.String()
+	return nil
+}
+
+// exportBatch writes the next part of the export of the company at key and
+// advances o.  The first part holds the company data, the next ones the
+// audit log and each later part the next batch of bills, with their events,
+// payments, bill files and proofs of payment.  After the last bills o moves
+// on to archiving.
+func (ctx *Context) exportBatch(key *datastore.Key, o *Offboarding) error {
+	if len(o.ExportParts) == 0 {
+		return ctx.exportCompanyData(key, o)
+	}
+
+	if o.Kind == "AuditEvent" {
+		return ctx.exportAuditEvents(key, o)
+	}
+
+	q := datastore.NewQuery("Bill").Ancestor(key).Limit(offboardBatchSize)
+	if o.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(o.Cursor)
+		if err != nil {
+			return err
+		}
+		q = q.Start(cursor)
+	}
+
+	t := q.Run(ctx.c)
+	bills := []*billExport{}
+	files := []appengine.BlobKey{}
+	active := 0
+	for {
+		b := &billExport{Bill: new(Bill)}
+		k, err := t.Next(b.Bill)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		b.Key = k
+
+		_, err = datastore.NewQuery("BillEvent").Ancestor(k).Order("On").GetAll(ctx.c, &b.Events)
+		if err != nil {
+			return err
+		}
+
+		_, err = datastore.NewQuery("Payment").Ancestor(k).Order("PaidOn").GetAll(ctx.c, &b.Payments)
+		if err != nil {
+			return err
+		}
+
+		if notDeleted(b.Bill) {
+			active++
+		}
+
+		if b.BlobKey != "" {
+			files = append(files, b.BlobKey)
+		}
+		for _, p := range b.Payments {
+			if p.ProofBlobKey != "" {
+				files = append(files, p.ProofBlobKey)
+			}
+		}
+
+		bills = append(bills, b)
+	}
+
+	if len(bills) > 0 {
+		part, err := ctx.writeExportPart("bills.json", bills, files)
+		if err != nil {
+			return err
+		}
+
+		o.ExportParts = append(o.ExportParts, part)
+		o.Total += active
+	}
+
+	if len(bills) < offboardBatchSize {
+		o.State = OffboardArchiving
+		o.Kind = offboardKinds[0]
+		o.Cursor = ""
+		return nil
+	}
+
+	cursor, err := t.Cursor()
+	if err != nil {
+		return err
+	}
+
+	o.Cursor = cursor.String()
+	return nil
+}
+
+// nextOffboardKind returns the kind archived after kind, or "" after the
+// last one.
+func nextOffboardKind(kind string) string {
+	for idx, k := range offboardKinds[:len(offboardKinds)-1] {
+		if k == kind {
+			return offboardKinds[idx+1]
+		}
+	}
+	return ""
+}
+
+// archiveBatch moves the next batch of o.Kind entities under the company at
+// key to the trash, in a single transaction, and advances o to the next
+// batch.  When every kind is done the company itself is moved to the trash,
+// unless something was added to it meanwhile, in which case archiving starts
+// over.
+func (ctx *Context) archiveBatch(key *datastore.Key, o *Offboarding) error {
+	if o.Kind == "" {
+		found, err := companyHasDependents(ctx.c, key)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			o.Kind = offboardKinds[0]
+			return nil
+		}
+
+		err = ctx.moveToTrash(key, nil)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		o.State = OffboardDone
+		o.FinishedOn = time.Now()
+		return nil
+	}
+
+	q := datastore.NewQuery(o.Kind).Ancestor(key).KeysOnly().Limit(offboardBatchSize)
+	if o.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(o.Cursor)
+		if err != nil {
+			return err
+		}
+		q = q.Start(cursor)
+	}
+
+	t := q.Run(ctx.c)
+	var keys []*datastore.Key
+	for {
+		k, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+
+	archived := 0
+	err := datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		archived = 0
+		for _, k := range keys {
+			v, err := newTrashEntity(o.Kind)
+			if err != nil {
+				return err
+			}
+
+			err = datastore.Get(c, k, v)
+			if err == datastore.ErrNoSuchEntity {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if !notDeleted(v) {
+				continue
+			}
+
+			// A bill still in a payment batch leaves it, so the batch
+			// can be cancelled.
+			if b, ok := v.(*Bill); ok {
+				b.BatchKey = nil
+			}
+
+			err = ctx.trashEntity(c, k, v)
+			if err != nil {
+				return err
+			}
+			archived++
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	o.Archived += archived
+
+	if len(keys) < offboardBatchSize {
+		o.Kind = nextOffboardKind(o.Kind)
+		o.Cursor = ""
+		return nil
+	}
+
+	cursor, err := t.Cursor()
+	if err != nil {
+		return err
+	}
+
+	o.Cursor = cursor.String()
+	return nil
+}
+
+// runOffboarding does the next step of the offboarding of the company at key
+// and queues the step after it.
+func (ctx *Context) runOffboarding(key *datastore.Key, o *Offboarding) error {
+	var err error
+	switch o.State {
+	case OffboardExporting:
+		err = ctx.exportBatch(key, o)
+	case OffboardArchiving:
+		err = ctx.archiveBatch(key, o)
+	default:
+		return nil
+	}
+
+	if err != nil {
+		o.Error = err.Error()
+		_, perr := datastore.Put(ctx.c, o.Key, o)
+		if perr != nil {
+			ctx.c.Errorf("could not save offboarding error: %v", perr)
+		}
+		return err
+	}
+
+	o.Error = ""
+	err = datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		_, err := datastore.Put(c, o.Key, o)
+		if err != nil || !o.Running() {
+			return err
+		}
+
+		return queueOffboardTask(c, key)
+	}, nil)
+
+	return err
+}
+
+// handleOffboardTask runs one step of an offboarding.  Tasks are run on
+// behalf of the admin who started the offboarding, so that the audit log
+// records them.  A failed step returns an error and is retried by the queue.
+func handleOffboardTask(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Header.Get("X-AppEngine-QueueName") == "" {
+		return datastore.ErrNoSuchEntity
+	}
+
+	key, err := datastore.DecodeKey(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	o, err := ctx.GetOffboarding(key)
+	if err != nil {
+		return err
+	}
+
+	if o == nil {
+		ctx.c.Errorf("no offboarding for company %v", key)
+		return nil
+	}
+
+	ctx.user = &user.User{Email: o.StartedBy}
+	ctx.admin = true
+
+	return ctx.runOffboarding(key, o)
+}
+
+type OffboardPage struct {
+	Company     *Company
+	Offboarding *Offboarding
+}
+
+func handleAdminCompanyOffboard(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	c, err := ctx.GetCompanyByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	if r.Method != "POST" {
+		o, err := ctx.GetOffboarding(c.Key)
+		if err != nil {
+			return err
+		}
+
+		return ctx.renderAdmin(offboardTmpl, OffboardPage{c, o})
+	}
+
+	err = ctx.StartOffboarding(c.Key)
+	if ierr, ok := err.(InUseError); ok {
+		ctx.Flash("%s", ierr.Error())
+		return ctx.Redirect("/admin/company/offboard?id=" + c.ID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Offboarding of %s started", c.Name)
+	return ctx.Redirect("/admin/company/offboard?id=" + c.ID)
+}
+
+func handleAdminCompanyExport(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	key, err := datastore.DecodeKey(r.FormValue("id"))
+	if err != nil {
+		return datastore.ErrNoSuchEntity
+	}
+
+	o, err := ctx.GetOffboarding(key)
+	if err != nil {
+		return err
+	}
+
+	part := getFormFieldInt(r.Form, "part")
+	if o == nil || part < 1 || part > len(o.ExportParts) {
+		return datastore.ErrNoSuchEntity
+	}
+
+	hdr := w.Header()
+	hdr.Set("Content-Disposition", fmt.Sprintf("attachment; filename=company-export-%d.zip", part))
+	hdr.Set("X-AppEngine-BlobKey", string(o.ExportParts[part-1]))
+	return nil
+}
@@ -0,0 +1,238 @@
+package billing
+
+import (
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"appengine/datastore"
+)
+
+const maxPageSize = 100
+
+var pageSizes = []int{10, 25, 50, maxPageSize}
+
+// Pager describes one page of a list query.  Datastore cursors only move
+// forward, so the cursors of the pages before the current one are kept in
+// the query string to build the previous link.
+//
+// Several lists can be paged on the same screen by giving each pager its own
+// Name, which prefixes its query string parameters.
+type Pager struct {
+	Name    string
+	Size    int
+	Cursor  string
+	History []string
+
+	next   string
+	values url.Values
+}
+
+// NewPager reads the page size and cursors for the pager called name from
+// the query string v.
+func NewPager(v url.Values, name string, defaultSize int) *Pager {
+	p := &Pager{
+		Name:   name,
+		Size:   defaultSize,
+		Cursor: v.Get(name + "cursor"),
+		values: v,
+	}
+
+	if size, err := strconv.Atoi(v.Get(name + "size")); err == nil && size > 0 {
+		p.Size = size
+	}
+
+	if p.Size > maxPageSize {
+		p.Size = maxPageSize
+	}
+
+	if prev := v.Get(name + "prev"); prev != "" {
+		p.History = strings.Split(prev, ".")
+	}
+
+	return p
+}
+
+func (p *Pager) HasNext() bool {
+	return p.next != ""
+}
+
+func (p *Pager) HasPrev() bool {
+	return p.Cursor != ""
+}
+
+func (p *Pager) NextURL() string {
+	history := append(append([]string{}, p.History...), p.Cursor)
+	return p.url(p.next, history)
+}
+
+func (p *Pager) PrevURL() string {
+	if len(p.History) == 0 {
+		return p.url("", nil)
+	}
+	last := len(p.History) - 1
+	return p.url(p.History[last], p.History[:last])
+}
+
+func (p *Pager) Sizes() []int {
+	return pageSizes
+}
+
+// SizeURL returns a link to the first page using size results per page.
+func (p *Pager) SizeURL(size int) string {
+	v := p.copyValues()
+	v.Del(p.Name + "cursor")
+	v.Del(p.Name + "prev")
+	v.Set(p.Name+"size", strconv.Itoa(size))
+	return "?" + v.Encode()
+}
+
+func (p *Pager) url(cursor string, history []string) string {
+	v := p.copyValues()
+	v.Del(p.Name + "cursor")
+	v.Del(p.Name + "prev")
+
+	if cursor != "" {
+		v.Set(p.Name+"cursor", cursor)
+	}
+
+	// The first page has an empty cursor, which is dropped from the history.
+	if len(history) > 0 && history[0] == "" {
+		history = history[1:]
+	}
+	if len(history) > 0 {
+		v.Set(p.Name+"prev", strings.Join(history, "."))
+	}
+
+	return "?" + v.Encode()
+}
+
+func (p *Pager) copyValues() url.Values {
+	v := url.Values{}
+	for k, vals := range p.values {
+		v[k] = append([]string{}, vals...)
+	}
+	return v
+}
+
+// maxPageScan bounds how many entities getPageWhere reads looking for
+// matches before it ends the page early.
+const maxPageScan = 1000
+
+// getPage runs q for the page described by p and appends the results to
+// dst, which must be a pointer to a slice of struct pointers.  If p is nil
+// every result is returned.
+func (ctx *Context) getPage(q *datastore.Query, p *Pager, dst interface{}) ([]*datastore.Key, error) {
+	return ctx.getPageWhere(q, p, dst, nil)
+}
+
+// getPageWhere is like getPage but skips entities for which match returns
+// false.  It is used for filters the datastore cannot apply in the same
+// query, so each page is still filled up to the page size.
+func (ctx *Context) getPageWhere(q *datastore.Query, p *Pager, dst interface{}, match func(interface{}) bool) ([]*datastore.Key, error) {
+	sv := reflect.ValueOf(dst).Elem()
+	elemType := sv.Type().Elem().Elem()
+
+	if p == nil {
+		if match == nil {
+			return q.GetAll(ctx.c, dst)
+		}
+		return ctx.getAllWhere(q, dst, match)
+	}
+
+	if p.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(p.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Start(cursor)
+	}
+
+	// Without a filter ask for one more result than we show to find out if
+	// there is a next page.
+	if match == nil {
+		q = q.Limit(p.Size + 1)
+	}
+	t := q.Run(ctx.c)
+
+	var keys []*datastore.Key
+	for scanned := 0; len(keys) < p.Size; scanned++ {
+		if scanned == maxPageScan {
+			return keys, p.setNext(t)
+		}
+
+		ev := reflect.New(elemType)
+		k, err := t.Next(ev.Interface())
+		if err == datastore.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return keys, err
+		}
+
+		if match != nil && !match(ev.Interface()) {
+			continue
+		}
+
+		keys = append(keys, k)
+		sv.Set(reflect.Append(sv, ev))
+	}
+
+	cursor, err := t.Cursor()
+	if err != nil {
+		return keys, err
+	}
+
+	// Look for one more match before offering a next page.
+	for scanned := 0; scanned < maxPageScan; scanned++ {
+		ev := reflect.New(elemType)
+		_, err = t.Next(ev.Interface())
+		if err == datastore.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return keys, err
+		}
+
+		if match == nil || match(ev.Interface()) {
+			break
+		}
+	}
+
+	p.next = cursor.String()
+	return keys, nil
+}
+
+// getAllWhere returns every result of q for which match returns true.
+// Unlike a page it is not bounded by maxPageScan.
+func (ctx *Context) getAllWhere(q *datastore.Query, dst interface{}, match func(interface{}) bool) ([]*datastore.Key, error) {
+	all := reflect.New(reflect.TypeOf(dst).Elem())
+	keys, err := q.GetAll(ctx.c, all.Interface())
+	if err != nil {
+		return nil, err
+	}
+
+	sv := reflect.ValueOf(dst).Elem()
+	matched := []*datastore.Key{}
+	for idx, k := range keys {
+		ev := all.Elem().Index(idx)
+		if match(ev.Interface()) {
+			matched = append(matched, k)
+			sv.Set(reflect.Append(sv, ev))
+		}
+	}
+
+	return matched, nil
+}
+
+// setNext points the next page at the current position of t.
+func (p *Pager) setNext(t *datastore.Iterator) error {
+	cursor, err := t.Cursor()
+	if err != nil {
+		return err
+	}
+
+	p.next = cursor.String()
+	return nil
+}
@@ -0,0 +1,290 @@
+package billing
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+)
+
+const (
+	PaymentMethodCheck = "check"
+	PaymentMethodACH   = "ach"
+	PaymentMethodWire  = "wire"
+	PaymentMethodCard  = "card"
+)
+
+type PaymentMethod struct {
+	Value string
+	Label string
+}
+
+var paymentMethods = []PaymentMethod{
+	{PaymentMethodCheck, "Check"},
+	{PaymentMethodACH, "ACH"},
+	{PaymentMethodWire, "Wire"},
+	{PaymentMethodCard, "Card"},
+}
+
+func validPaymentMethod(m string) bool {
+	for _, pm := range paymentMethods {
+		if pm.Value == m {
+			return true
+		}
+	}
+	return false
+}
+
+// Payment records how all or part of a bill was settled.  Payments are
+// children of the bill they pay.  A payment is never deleted; undoing it
+// marks it voided.
+type Payment struct {
+	Key          *datastore.Key `datastore:"-"`
+	Method       string
+	Reference    string
+	PaidOn       time.Time
+	Amt          int
+	ProofBlobKey appengine.BlobKey
+	RecordedBy   string
+	RecordedOn   time.Time
+
+	Voided     bool
+	VoidedBy   string
+	VoidedOn   time.Time
+	VoidReason string
+}
+
+func (p *Payment) MethodLabel() string {
+	for _, pm := range paymentMethods {
+		if pm.Value == p.Method {
+			return pm.Label
+		}
+	}
+	return p.Method
+}
+
+// newPaymentFromUpload builds a payment from the fields and blobs of a
+// blobstore upload.  The proof of payment file is optional.
+func newPaymentFromUpload(blobs map[string][]*blobstore.BlobInfo, fields url.Values) *Payment {
+	p := &Payment{
+		Method:    getFormFieldString(fields, "method"),
+		Reference: getFormFieldString(fields, "reference"),
+		PaidOn:    getFormFieldDate(fields, "paid_on"),
+		Amt:       getFormFieldMoney(fields, "amount"),
+	}
+
+	if proof := blobs["proof"]; len(proof) > 0 {
+		p.ProofBlobKey = proof[0].BlobKey
+	}
+
+	return p
+}
+
+// discardProof removes an uploaded proof of payment that will not be saved.
+func (ctx *Context) discardProof(p *Payment) {
+	if p.ProofBlobKey == "" {
+		return
+	}
+
+	err := blobstore.Delete(ctx.c, p.ProofBlobKey)
+	if err != nil {
+		ctx.c.Errorf("could not delete proof of payment %s: %v", p.ProofBlobKey, err)
+	}
+}
+
+// Validate returns a list of problems with the payment details.
+func (p *Payment) Validate() []string {
+	errs := []string{}
+
+	if !validPaymentMethod(p.Method) {
+		errs = append(errs, "You must choose a payment method")
+	}
+
+	if p.PaidOn.IsZero() {
+		errs = append(errs, "Payment date must be valid")
+	} else if p.PaidOn.After(time.Now()) {
+		errs = append(errs, "Payment date cannot be in the future")
+	}
+
+	if p.Amt <= 0 {
+		errs = append(errs, "Paid amount must be greater than 0")
+	}
+
+	if p.Method == PaymentMethodCheck && p.Reference == "" {
+		errs = append(errs, "You must enter the check number")
+	}
+
+	return errs
+}
+
+// PayBill records p against the bill at key and stores it as a child of the
+// bill, along with a BillEvent, in a single transaction.  The bill is marked
+// paid once its full amount has been paid.  justification is used as in
+// UpdateBillStatus.
+func (ctx *Context) PayBill(key *datastore.Key, p *Payment, justification string) (*Bill, error) {
+	p.RecordedBy = ctx.user.String()
+	p.RecordedOn = time.Now()
+
+	return ctx.updateBill(key, BillActionPay, "", justification, func(c appengine.Context, b *Bill) error {
+		if b.BatchKey != nil {
+			return BillStatusError("Bill is in a payment batch and will be paid when the batch is confirmed")
+		}
+
+		err := b.addPayment(p, p.RecordedBy, p.RecordedOn)
+		if err != nil {
+			return err
+		}
+
+		k, err := datastore.Put(c, datastore.NewIncompleteKey(c, "Payment", key), p)
+		p.Key = k
+		return err
+	})
+}
+
+// addPayment adds p to the amount paid on the bill and marks the bill paid
+// once the balance reaches zero, or once the discounted amount has been paid
+// within the discount window.  Payments larger than the outstanding balance
+// are rejected.
+func (b *Bill) addPayment(p *Payment, by string, now time.Time) error {
+	balance := b.Balance()
+	if p.Amt > balance {
+		return BillStatusError(fmt.Sprintf("Payment of %s is more than the outstanding balance of %s", tmplMoney(p.Amt), tmplMoney(balance)))
+	}
+
+	b.PaidAmt += p.Amt
+	if b.PaidAmt < b.Amt && b.discountAppliesOn(p.PaidOn) && b.PaidAmt >= b.Amt-b.DiscountAmt {
+		b.DiscountTaken = b.Amt - b.PaidAmt
+	}
+
+	if b.PaidAmt+b.DiscountTaken >= b.Amt {
+		b.Paid = true
+		b.PaidOn = now
+		b.PaidBy = by
+		b.SettledOn = p.PaidOn
+	}
+
+	return nil
+}
+
+// voidPayments marks every payment on the bill voided.  It must be called
+// inside a transaction on the bill's entity group.
+func voidPayments(c appengine.Context, key *datastore.Key, by, reason string, now time.Time) error {
+	var payments []*Payment
+	keys, err := datastore.NewQuery("Payment").Ancestor(key).Filter("Voided =", false).GetAll(c, &payments)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range payments {
+		p.Voided = true
+		p.VoidedBy = by
+		p.VoidedOn = now
+		p.VoidReason = reason
+	}
+
+	_, err = datastore.PutMulti(c, keys, payments)
+	return err
+}
+
+func (ctx *Context) GetBillPayments(b *Bill) ([]*Payment, error) {
+	payments := make([]*Payment, 0, 5)
+	q := datastore.NewQuery("Payment").Ancestor(b.Key).Order("PaidOn")
+	keys, err := q.GetAll(ctx.c, &payments)
+	if err != nil {
+		return payments, err
+	}
+
+	for idx, k := range keys {
+		payments[idx].Key = k
+	}
+
+	return payments, nil
+}
+
+// Installment is one planned payment in a bill's installment schedule.
+type Installment struct {
+	DueOn time.Time
+	Amt   int
+}
+
+// InstallmentStatus is an installment along with how much of it has been
+// covered by the payments made so far.
+type InstallmentStatus struct {
+	Installment
+	PaidAmt int
+}
+
+func (i InstallmentStatus) Paid() bool {
+	return i.PaidAmt >= i.Amt
+}
+
+// Schedule applies the amount paid on the bill to its installments in due
+// date order.
+func (b *Bill) Schedule() []InstallmentStatus {
+	paid := b.PaidAmt
+	if b.Paid {
+		paid = b.Amt
+	}
+
+	schedule := make([]InstallmentStatus, len(b.Installments))
+	for idx, i := range b.Installments {
+		schedule[idx].Installment = i
+		if paid >= i.Amt {
+			schedule[idx].PaidAmt = i.Amt
+		} else if paid > 0 {
+			schedule[idx].PaidAmt = paid
+		}
+		paid -= schedule[idx].PaidAmt
+	}
+
+	return schedule
+}
+
+// validateInstallments checks that a schedule is in due date order and adds
+// up to the bill amount.
+func validateInstallments(b *Bill, installments []Installment) []string {
+	errs := []string{}
+
+	total := 0
+	for idx, i := range installments {
+		if i.DueOn.IsZero() {
+			errs = append(errs, fmt.Sprintf("Installment %d must have a due date", idx+1))
+		}
+		if i.Amt <= 0 {
+			errs = append(errs, fmt.Sprintf("Installment %d amount must be greater than 0", idx+1))
+		}
+		if idx > 0 && i.DueOn.Before(installments[idx-1].DueOn) {
+			errs = append(errs, "Installments must be in due date order")
+		}
+		total += i.Amt
+	}
+
+	if len(installments) > 0 && total != b.Amt {
+		errs = append(errs, fmt.Sprintf("Installments add up to %s but the bill is for %s", tmplMoney(total), tmplMoney(b.Amt)))
+	}
+
+	return errs
+}
+
+// SetBillInstallments replaces the installment schedule of the bill at key.
+func (ctx *Context) SetBillInstallments(key *datastore.Key, installments []Installment) error {
+	return datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		b := new(Bill)
+		err := datastore.Get(c, key, b)
+		if err != nil {
+			return err
+		}
+
+		before := *b
+		b.Installments = installments
+		_, err = datastore.Put(c, key, b)
+		if err != nil {
+			return err
+		}
+
+		return ctx.recordAudit(c, AuditUpdate, key, &before, b)
+	}, nil)
+}
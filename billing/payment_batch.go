@@ -0,0 +1,902 @@
+package billing
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// Payment batch states.  A batch is generated from a set of bills, sent to
+// the bank as a file and confirmed once the bank has accepted it, which
+// marks its bills paid.
+const (
+	BatchGenerated = "generated"
+	BatchConfirmed = "confirmed"
+	BatchCancelled = "cancelled"
+)
+
+// Payment batch methods.  ACH batches are sent to the bank as NACHA files
+// and credit transfer batches as ISO 20022 pain.001 messages.  Check
+// batches are printed.
+var batchMethods = []PaymentMethod{
+	{PaymentMethodACH, "ACH (NACHA file)"},
+	{PaymentMethodWire, "Credit transfer (ISO 20022)"},
+	{PaymentMethodCheck, "Printed checks"},
+}
+
+// maxEntryAmt is the largest amount in cents a single entry can pay; the
+// NACHA amount field has ten digits.
+const maxEntryAmt = 9999999999
+
+// BatchEntry is the payment of one bill in a batch.  The vendor's bank
+// details and address are copied when the batch is generated so the file
+// always pays the account that was reviewed.  CheckNum is the check that
+// pays the bill in check batches.  Override is the justification given for
+// batching a bill against a segregation of duties rule.
+type BatchEntry struct {
+	BillKey     *datastore.Key
+	VendorKey   *datastore.Key
+	VendorName  string
+	InvoiceNum  string
+	InvoiceDate time.Time
+	Amt         int
+	Discount    int
+	Bank        BankAccount
+	RemitTo     Address
+	CheckNum    int
+	Override    string `datastore:",noindex"`
+	Paid        bool
+	Error       string `datastore:",noindex"`
+
+	// A voided entry's check was voided and will not be paid.
+	Voided     bool
+	VoidedOn   time.Time
+	VoidedBy   string
+	VoidReason string
+}
+
+// PaymentBatch groups approved bills of one company that are paid together
+// through the bank.  Batches are children of the company.  Reference is
+// sent to the bank with the batch and recorded on each payment.  Currency
+// is the ISO 4217 code the entries are paid in, which is the currency of
+// the company's bills.
+type PaymentBatch struct {
+	Key         *datastore.Key `datastore:"-"`
+	CompanyKey  *datastore.Key
+	Method      string
+	SEC         string
+	Currency    string
+	Reference   string
+	State       string
+	EffectiveOn time.Time
+	Entries     []BatchEntry
+	Total       int
+	CreatedBy   string
+	CreatedOn   time.Time
+	ConfirmedBy string
+	ConfirmedOn time.Time
+
+	Company *Company `datastore:"-"`
+}
+
+func (pb *PaymentBatch) EncodedKey() string {
+	return pb.Key.Encode()
+}
+
+func (pb *PaymentBatch) IsACH() bool {
+	return pb.Method == PaymentMethodACH
+}
+
+func (pb *PaymentBatch) IsCheck() bool {
+	return pb.Method == PaymentMethodCheck
+}
+
+func (pb *PaymentBatch) Open() bool {
+	return pb.State == BatchGenerated
+}
+
+// VoidedCount is how many entries of the batch have had their check voided.
+func (pb *PaymentBatch) VoidedCount() int {
+	n := 0
+	for _, e := range pb.Entries {
+		if e.Voided {
+			n++
+		}
+	}
+	return n
+}
+
+// PaidCount is how many entries of the batch have been marked paid.
+func (pb *PaymentBatch) PaidCount() int {
+	n := 0
+	for _, e := range pb.Entries {
+		if e.Paid {
+			n++
+		}
+	}
+	return n
+}
+
+// batchAmount returns what a payment made on day d settles b for, taking
+// the early payment discount if it still applies then.
+func batchAmount(b *Bill, d time.Time) int {
+	if b.discountAppliesOn(d) {
+		return b.Balance() - b.DiscountAmt
+	}
+	return b.Balance()
+}
+
+// batchProblem returns why b and its vendor v cannot be paid in a batch of
+// the given method, or "".
+func batchProblem(b *Bill, v *Vendor, method string) string {
+	switch {
+	case b.Deleted:
+		return "is in the trash"
+	case b.Paid:
+		return "is already paid"
+	case !b.Approved():
+		return "is not approved"
+	case b.BatchKey != nil:
+		return "is already in a payment batch"
+	case v == nil || v.Deleted:
+		return "has no vendor"
+	case v.BankChangePending:
+		return "is on hold for a bank details change of " + v.Name
+	case method == PaymentMethodACH && (v.Bank.RoutingNumber == "" || v.Bank.AccountNumber == ""):
+		return "has a vendor without a US bank account"
+	case method == PaymentMethodWire && !canTransferFrom(v.Bank):
+		return "has a vendor without an IBAN and BIC or a US bank account"
+	case method == PaymentMethodCheck && v.RemitTo.Line1 == "":
+		return "has a vendor without a remit-to address"
+	}
+	return ""
+}
+
+// GetBatchableBills returns the bills of company c that can be paid in a
+// batch of the given method, with their vendors loaded.
+func (ctx *Context) GetBatchableBills(c *Company, method string) ([]*Bill, error) {
+	bills, err := ctx.GetCompanyUnreconciledBills(c, nil)
+	if err != nil {
+		return bills, err
+	}
+
+	withVendor := []*Bill{}
+	for _, b := range bills {
+		if b.VendorKey != nil {
+			withVendor = append(withVendor, b)
+		}
+	}
+
+	err = ctx.LoadBillVendors(withVendor)
+	if err != nil {
+		return nil, err
+	}
+
+	batchable := []*Bill{}
+	for _, b := range withVendor {
+		if batchProblem(b, b.Vendor, method) == "" {
+			batchable = append(batchable, b)
+		}
+	}
+
+	return batchable, nil
+}
+
+// CreatePaymentBatch puts the bills at billKeys of the company at
+// companyKey in a new batch of the given method that settles on effective.
+// sec is the entry class of ACH batches.  Entries are paid in the currency
+// of the company, which must be US dollars for ACH and check batches.
+// Check batches get the next check numbers of the company.
+// The bills are marked as being in the batch so they cannot be paid any
+// other way until it is confirmed or cancelled.  The creator must be
+// allowed to pay each bill; justification is used as in UpdateBillStatus.
+func (ctx *Context) CreatePaymentBatch(companyKey *datastore.Key, billKeys []*datastore.Key, method, sec string, effective time.Time, justification string) (*PaymentBatch, error) {
+	if len(billKeys) == 0 {
+		return nil, BillStatusError("Select at least one bill to pay")
+	}
+
+	switch method {
+	case PaymentMethodACH:
+		if sec != SECCorporate && sec != SECPersonal {
+			return nil, BillStatusError("Select CCD or PPD entries")
+		}
+	case PaymentMethodWire, PaymentMethodCheck:
+		sec = ""
+	default:
+		return nil, BillStatusError("Select ACH, credit transfer or checks")
+	}
+
+	id, _, err := datastore.AllocateIDs(ctx.c, "PaymentBatch", companyKey, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	key := datastore.NewKey(ctx.c, "PaymentBatch", "", id, companyKey)
+	pb := &PaymentBatch{
+		Key:         key,
+		CompanyKey:  companyKey,
+		Method:      method,
+		SEC:         sec,
+		Reference:   strings.ToUpper(method) + strconv.FormatInt(id, 10),
+		State:       BatchGenerated,
+		EffectiveOn: effective,
+		CreatedBy:   ctx.user.String(),
+		CreatedOn:   time.Now(),
+	}
+
+	err = datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		pb.Entries = nil
+		pb.Total = 0
+
+		company := new(Company)
+		err := datastore.Get(c, companyKey, company)
+		if err != nil {
+			return err
+		}
+
+		if method == PaymentMethodACH && !company.CanOriginateACH() {
+			return BillStatusError("Set up the bank account and ACH company ID of " + company.Name + " first")
+		}
+
+		if method == PaymentMethodWire && !company.CanOriginateTransfers() {
+			return BillStatusError("Set up the IBAN and BIC or US bank account of " + company.Name + " first")
+		}
+
+		if method == PaymentMethodCheck && !company.CanPrintChecks() {
+			return BillStatusError("Set up the bank account of " + company.Name + " first")
+		}
+
+		pb.Currency = company.BillCurrency()
+		if method != PaymentMethodWire && pb.Currency != "USD" {
+			return BillStatusError("The bills of " + company.Name + " are in " + pb.Currency + " and can only be paid by credit transfer")
+		}
+
+		// A transaction does not see its own writes, so a bill listed twice
+		// would be paid twice.
+		seen := map[string]bool{}
+		for _, k := range billKeys {
+			if seen[k.Encode()] {
+				continue
+			}
+			seen[k.Encode()] = true
+
+			b := new(Bill)
+			err := datastore.Get(c, k, b)
+			if err != nil {
+				return err
+			}
+
+			if b.CompanyKey == nil || !b.CompanyKey.Equal(companyKey) {
+				return datastore.ErrNoSuchEntity
+			}
+
+			var v *Vendor
+			if b.VendorKey != nil {
+				v = new(Vendor)
+				err = datastore.Get(c, b.VendorKey, v)
+				if err != nil {
+					return err
+				}
+			}
+
+			if msg := batchProblem(b, v, method); msg != "" {
+				return BillStatusError(fmt.Sprintf("Invoice %s %s", b.InvoiceNum, msg))
+			}
+
+			override, err := ctx.checkDuties(company, b, BillActionPay, pb.CreatedBy, justification)
+			if err != nil {
+				return BillStatusError(fmt.Sprintf("Invoice %s: %s", b.InvoiceNum, err.Error()))
+			}
+
+			amt := batchAmount(b, effective)
+			if amt <= 0 || (method == PaymentMethodACH && amt > maxEntryAmt) {
+				return BillStatusError(fmt.Sprintf("Invoice %s cannot be paid for %s in a batch", b.InvoiceNum, tmplMoney(amt)))
+			}
+
+			pb.Entries = append(pb.Entries, BatchEntry{
+				BillKey:     k,
+				VendorKey:   b.VendorKey,
+				VendorName:  v.Name,
+				InvoiceNum:  b.InvoiceNum,
+				InvoiceDate: b.Date,
+				Amt:         amt,
+				Discount:    b.Balance() - amt,
+				Bank:        v.Bank,
+				RemitTo:     v.RemitTo,
+				Override:    override,
+			})
+			pb.Total += amt
+
+			before := *b
+			b.BatchKey = key
+			_, err = datastore.Put(c, k, b)
+			if err != nil {
+				return err
+			}
+
+			err = ctx.recordAudit(c, AuditUpdate, k, &before, b)
+			if err != nil {
+				return err
+			}
+		}
+
+		if method == PaymentMethodCheck {
+			before := *company
+			company.setNextCheck(numberChecks(pb.Entries, company.NextCheck()))
+			_, err = datastore.Put(c, companyKey, company)
+			if err != nil {
+				return err
+			}
+
+			err = ctx.recordAudit(c, AuditUpdate, companyKey, &before, company)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = datastore.Put(c, key, pb)
+		return err
+	}, nil)
+
+	return pb, err
+}
+
+func (ctx *Context) GetPaymentBatchByID(id string) (*PaymentBatch, error) {
+	pb := new(PaymentBatch)
+	k, err := datastore.DecodeKey(id)
+	if err != nil {
+		return pb, datastore.ErrNoSuchEntity
+	}
+
+	pb.Key = k
+	err = datastore.Get(ctx.c, k, pb)
+	if err != nil {
+		return pb, err
+	}
+
+	pb.Company = new(Company)
+	err = datastore.Get(ctx.c, pb.CompanyKey, pb.Company)
+	pb.Company.ID = pb.CompanyKey.Encode()
+	pb.Company.Key = pb.CompanyKey
+
+	return pb, err
+}
+
+func (ctx *Context) GetPaymentBatches(p *Pager) ([]*PaymentBatch, error) {
+	batches := make([]*PaymentBatch, 0, 20)
+	q := datastore.NewQuery("PaymentBatch").Order("-CreatedOn")
+	keys, err := ctx.getPage(q, p, &batches)
+	if err != nil {
+		return batches, err
+	}
+
+	companyKeys := make([]*datastore.Key, len(keys))
+	for idx, k := range keys {
+		batches[idx].Key = k
+		companyKeys[idx] = batches[idx].CompanyKey
+	}
+
+	companies, err := ctx.GetCompanyMulti(companyKeys)
+	if err != nil {
+		return batches, err
+	}
+
+	for idx, b := range batches {
+		b.Company = companies[idx]
+	}
+
+	return batches, nil
+}
+
+// entryReference is the payment reference of entry e: the check number in
+// check batches and the batch reference otherwise.
+func (pb *PaymentBatch) entryReference(e *BatchEntry) string {
+	if e.CheckNum != 0 {
+		return strconv.Itoa(e.CheckNum)
+	}
+	return pb.Reference
+}
+
+// settle marks an open batch confirmed once every entry is paid or voided.
+func (pb *PaymentBatch) settle(by string, now time.Time) {
+	if pb.Open() && pb.PaidCount()+pb.VoidedCount() == len(pb.Entries) {
+		pb.State = BatchConfirmed
+		pb.ConfirmedBy = by
+		pb.ConfirmedOn = now
+	}
+}
+
+// batchEntry loads the batch at key in transaction c along with its entry
+// idx.  Batches share the entity group of their bills, so entries are
+// updated in the same transaction as the bill they pay.
+func batchEntry(c appengine.Context, key *datastore.Key, idx int) (*PaymentBatch, *BatchEntry, error) {
+	pb := new(PaymentBatch)
+	err := datastore.Get(c, key, pb)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if idx >= len(pb.Entries) {
+		return nil, nil, datastore.ErrNoSuchEntity
+	}
+
+	pb.Key = key
+	return pb, &pb.Entries[idx], nil
+}
+
+// batchPaymentExists reports whether the bill at key has a payment with
+// reference ref that is not voided.  It must be called inside a
+// transaction on the bill's entity group.
+func batchPaymentExists(c appengine.Context, key *datastore.Key, ref string) (bool, error) {
+	var payments []*Payment
+	_, err := datastore.NewQuery("Payment").Ancestor(key).Filter("Voided =", false).GetAll(c, &payments)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range payments {
+		if p.Reference == ref {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ConfirmPaymentBatch records the payment of every entry of batch pb that
+// is not yet paid or voided, once the bank has accepted the file.  Each bill
+// is paid in its own transaction, which also marks its entry paid; bills
+// that cannot be paid keep the reason on their entry and the batch stays
+// open so it can be confirmed again.  pb is reloaded afterwards.
+func (ctx *Context) ConfirmPaymentBatch(pb *PaymentBatch, justification string) error {
+	if !pb.Open() {
+		return BillStatusError("This payment batch is " + pb.State)
+	}
+
+	by := ctx.user.String()
+	now := time.Now()
+	for idx := range pb.Entries {
+		idx, e := idx, pb.Entries[idx]
+		if e.Paid || e.Voided {
+			continue
+		}
+
+		p := &Payment{
+			Method:     pb.Method,
+			Reference:  pb.entryReference(&e),
+			PaidOn:     pb.EffectiveOn,
+			Amt:        e.Amt,
+			RecordedBy: by,
+			RecordedOn: now,
+		}
+
+		_, err := ctx.updateBill(e.BillKey, BillActionPay, "", justification, func(c appengine.Context, b *Bill) error {
+			batch, entry, err := batchEntry(c, pb.Key, idx)
+			if err != nil {
+				return err
+			}
+
+			if !batch.Open() {
+				return BillStatusError("This payment batch is " + batch.State)
+			}
+
+			if entry.Paid || entry.Voided {
+				return BillStatusError("Entry is no longer outstanding")
+			}
+
+			if b.BatchKey == nil || !b.BatchKey.Equal(pb.Key) {
+				return BillStatusError("Bill is no longer in this batch")
+			}
+
+			err = b.addPayment(p, by, now)
+			if err != nil {
+				return err
+			}
+
+			b.BatchKey = nil
+			_, err = datastore.Put(c, datastore.NewIncompleteKey(c, "Payment", e.BillKey), p)
+			if err != nil {
+				return err
+			}
+
+			entry.Paid = true
+			entry.Error = ""
+			batch.settle(by, now)
+			_, err = datastore.Put(c, pb.Key, batch)
+			return err
+		})
+
+		if serr, ok := err.(BillStatusError); ok {
+			err = ctx.failBatchEntry(pb.Key, idx, serr.Error(), now)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Entries voided since the batch was loaded may leave nothing to pay.
+	var batch *PaymentBatch
+	err := datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		batch = new(PaymentBatch)
+		err := datastore.Get(c, pb.Key, batch)
+		if err != nil || !batch.Open() {
+			return err
+		}
+
+		batch.settle(by, now)
+		if batch.Open() {
+			return nil
+		}
+
+		_, err = datastore.Put(c, pb.Key, batch)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	batch.Key = pb.Key
+	batch.Company = pb.Company
+	*pb = *batch
+	return nil
+}
+
+// failBatchEntry records msg as the reason entry idx of the batch at key
+// could not be paid.  An entry whose bill already has a payment from the
+// batch is marked paid instead, as an earlier confirmation paid it.
+func (ctx *Context) failBatchEntry(key *datastore.Key, idx int, msg string, now time.Time) error {
+	return datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		pb, e, err := batchEntry(c, key, idx)
+		if err != nil {
+			return err
+		}
+
+		if e.Paid || e.Voided {
+			return nil
+		}
+
+		paid, err := batchPaymentExists(c, e.BillKey, pb.entryReference(e))
+		if err != nil {
+			return err
+		}
+
+		if paid {
+			e.Paid = true
+			e.Error = ""
+			pb.settle(ctx.user.String(), now)
+		} else {
+			e.Error = msg
+		}
+
+		_, err = datastore.Put(c, key, pb)
+		return err
+	}, nil)
+}
+
+// releaseBill takes the bill at key out of the batch at batchKey so it can
+// be paid another way.  It must be called inside a transaction.
+func (ctx *Context) releaseBill(c appengine.Context, key, batchKey *datastore.Key) error {
+	b := new(Bill)
+	err := datastore.Get(c, key, b)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if b.BatchKey == nil || !b.BatchKey.Equal(batchKey) {
+		return nil
+	}
+
+	before := *b
+	b.BatchKey = nil
+	_, err = datastore.Put(c, key, b)
+	if err != nil {
+		return err
+	}
+
+	return ctx.recordAudit(c, AuditUpdate, key, &before, b)
+}
+
+// CancelPaymentBatch releases the bills of the batch at key so they can be
+// paid another way.  Batches with a bill that has been paid by the batch
+// cannot be cancelled.  The checks of a cancelled check batch are voided,
+// as they may have been printed already.
+func (ctx *Context) CancelPaymentBatch(key *datastore.Key) error {
+	return datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		pb := new(PaymentBatch)
+		err := datastore.Get(c, key, pb)
+		if err != nil {
+			return err
+		}
+
+		if !pb.Open() {
+			return BillStatusError("This payment batch is " + pb.State)
+		}
+
+		if pb.PaidCount() > 0 {
+			return BillStatusError("Some bills of this batch are already paid")
+		}
+
+		for idx := range pb.Entries {
+			e := &pb.Entries[idx]
+			if e.Voided {
+				continue
+			}
+
+			paid, err := batchPaymentExists(c, e.BillKey, pb.entryReference(e))
+			if err != nil {
+				return err
+			}
+
+			if paid {
+				return BillStatusError(fmt.Sprintf("Invoice %s is already paid by this batch", e.InvoiceNum))
+			}
+		}
+
+		now := time.Now()
+		for idx := range pb.Entries {
+			e := &pb.Entries[idx]
+			err := ctx.releaseBill(c, e.BillKey, key)
+			if err != nil {
+				return err
+			}
+
+			if pb.IsCheck() && !e.Voided {
+				e.Voided = true
+				e.VoidedOn = now
+				e.VoidedBy = ctx.user.String()
+				e.VoidReason = "Payment batch cancelled"
+			}
+		}
+
+		pb.State = BatchCancelled
+		_, err = datastore.Put(c, key, pb)
+		return err
+	}, nil)
+}
+
+type PaymentBatchesPage struct {
+	Batches []*PaymentBatch
+	Pager   *Pager
+}
+
+func handleAdminPayments(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	p := NewPager(r.URL.Query(), "", 20)
+	batches, err := ctx.GetPaymentBatches(p)
+	if err != nil {
+		return err
+	}
+
+	return ctx.renderAdmin(paymentsTmpl, PaymentBatchesPage{batches, p})
+}
+
+type NewPaymentBatchForm struct {
+	Companies      []*Company
+	Company        *Company
+	Bills          []*Bill
+	Method         string
+	SEC            string
+	EffectiveOn    time.Time
+	Methods        []PaymentMethod
+	ValidationErrs []string
+}
+
+func renderPaymentBatchForm(ctx *Context, f NewPaymentBatchForm) error {
+	var err error
+	f.Companies, err = ctx.GetAllCompanies(nil)
+	if err != nil {
+		return err
+	}
+
+	if f.Company != nil {
+		f.Bills, err = ctx.GetBatchableBills(f.Company, f.Method)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ctx.renderAdmin(newPaymentBatchTmpl, f)
+}
+
+func handleAdminNewPaymentBatch(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	f := NewPaymentBatchForm{
+		Method:         PaymentMethodACH,
+		SEC:            SECCorporate,
+		EffectiveOn:    today().AddDate(0, 0, 1),
+		Methods:        batchMethods,
+		ValidationErrs: []string{},
+	}
+
+	switch m := r.FormValue("method"); m {
+	case PaymentMethodWire, PaymentMethodCheck:
+		f.Method = m
+	}
+
+	if id := r.FormValue("company"); id != "" {
+		c, err := ctx.GetCompanyByID(id)
+		if err != nil {
+			return err
+		}
+		f.Company = c
+	}
+
+	if r.Method != "POST" || f.Company == nil {
+		return renderPaymentBatchForm(ctx, f)
+	}
+
+	f.SEC = r.FormValue("sec")
+	f.EffectiveOn = getFormFieldDate(r.Form, "effective_on")
+	if f.EffectiveOn.IsZero() || f.EffectiveOn.Before(today()) {
+		f.ValidationErrs = append(f.ValidationErrs, "Effective date must be today or later")
+	}
+
+	keys := []*datastore.Key{}
+	seen := map[string]bool{}
+	for _, id := range r.Form["bill"] {
+		k, err := datastore.DecodeKey(id)
+		if err != nil {
+			return datastore.ErrNoSuchEntity
+		}
+
+		if !seen[k.Encode()] {
+			seen[k.Encode()] = true
+			keys = append(keys, k)
+		}
+	}
+
+	if len(f.ValidationErrs) > 0 {
+		return renderPaymentBatchForm(ctx, f)
+	}
+
+	pb, err := ctx.CreatePaymentBatch(f.Company.Key, keys, f.Method, f.SEC, f.EffectiveOn, r.FormValue("justification"))
+	if serr, ok := err.(BillStatusError); ok {
+		f.ValidationErrs = append(f.ValidationErrs, serr.Error())
+		return renderPaymentBatchForm(ctx, f)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Payment batch %s created", pb.Reference)
+	return ctx.Redirect("/admin/payments/view?id=" + pb.EncodedKey())
+}
+
+func handleAdminPaymentBatch(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	pb, err := ctx.GetPaymentBatchByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	return ctx.renderAdmin(paymentBatchTmpl, pb)
+}
+
+func handleAdminPaymentBatchNACHA(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	pb, err := ctx.GetPaymentBatchByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	if pb.Method != PaymentMethodACH || pb.State == BatchCancelled {
+		return datastore.ErrNoSuchEntity
+	}
+
+	file, err := GenerateNACHA(pb.Company, pb, time.Now())
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Disposition", "attachment; filename="+pb.Reference+".ach")
+	_, err = w.Write(file)
+	return err
+}
+
+// handleAdminPaymentBatchPain001 sends a batch as a pain.001 message.  ACH
+// batches can be sent this way too, to banks that take pain.001 files for
+// domestic payments.
+func handleAdminPaymentBatchPain001(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	pb, err := ctx.GetPaymentBatchByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	if pb.IsCheck() || pb.State == BatchCancelled {
+		return datastore.ErrNoSuchEntity
+	}
+
+	file, err := GeneratePain001(pb.Company, pb, time.Now())
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Disposition", "attachment; filename="+pb.Reference+".xml")
+	_, err = w.Write(file)
+	return err
+}
+
+// handleAdminPaymentBatchChecks sends the checks of a check batch, or its
+// check register, as a PDF.
+func handleAdminPaymentBatchChecks(register bool) myHandler {
+	return func(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+		pb, err := ctx.GetPaymentBatchByID(r.FormValue("id"))
+		if err != nil {
+			return err
+		}
+
+		if !pb.IsCheck() {
+			return datastore.ErrNoSuchEntity
+		}
+
+		name := pb.Reference + "-checks.pdf"
+		var file []byte
+		if register {
+			name = pb.Reference + "-register.pdf"
+			file, err = GenerateCheckRegister(pb.Company, pb, time.Now())
+		} else if pb.Open() {
+			file, err = GenerateChecks(pb.Company, pb)
+		} else {
+			ctx.Flash("%s", "Checks of a "+pb.State+" batch cannot be printed")
+			return ctx.Redirect("/admin/payments/view?id=" + pb.EncodedKey())
+		}
+
+		if serr, ok := err.(BillStatusError); ok {
+			ctx.Flash("%s", serr.Error())
+			return ctx.Redirect("/admin/payments/view?id=" + pb.EncodedKey())
+		}
+
+		if err != nil {
+			return err
+		}
+
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", "attachment; filename="+name)
+		_, err = w.Write(file)
+		return err
+	}
+}
+
+func handleAdminPaymentBatchAction(confirm bool) myHandler {
+	return func(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+		id := r.FormValue("id")
+		if r.Method != "POST" {
+			return ctx.Redirect("/admin/payments/view?id=" + id)
+		}
+
+		pb, err := ctx.GetPaymentBatchByID(id)
+		if err != nil {
+			return err
+		}
+
+		msg := "Payment batch cancelled"
+		if confirm {
+			msg = "Payment batch confirmed"
+			err = ctx.ConfirmPaymentBatch(pb, r.FormValue("justification"))
+			if err == nil && pb.Open() {
+				msg = "Some bills could not be marked paid"
+			}
+		} else {
+			err = ctx.CancelPaymentBatch(pb.Key)
+		}
+
+		if serr, ok := err.(BillStatusError); ok {
+			ctx.Flash("%s", serr.Error())
+			return ctx.Redirect("/admin/payments/view?id=" + id)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		ctx.Flash("%s", msg)
+		return ctx.Redirect("/admin/payments/view?id=" + id)
+	}
+}
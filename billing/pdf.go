@@ -0,0 +1,138 @@
+package billing
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// PDF fonts.  Only the standard Type 1 fonts are used so nothing has to be
+// embedded.  Courier is monospaced, which makes right aligned amounts easy.
+const (
+	fontRegular = "F1"
+	fontBold    = "F2"
+	fontMono    = "F3"
+
+	// monoWidth is the advance of a Courier character per point of size.
+	monoWidth = 0.6
+)
+
+var pdfFonts = []struct{ Name, Base string }{
+	{fontRegular, "Helvetica"},
+	{fontBold, "Helvetica-Bold"},
+	{fontMono, "Courier"},
+}
+
+// Page size of US letter paper in points.
+const (
+	pageWidth  = 612
+	pageHeight = 792
+)
+
+// pdfDoc is a minimal PDF writer for printed forms: text and lines on
+// letter pages.  Coordinates are in points from the top left of the page.
+type pdfDoc struct {
+	pages []*bytes.Buffer
+	page  *bytes.Buffer
+}
+
+func (d *pdfDoc) newPage() {
+	d.page = new(bytes.Buffer)
+	d.pages = append(d.pages, d.page)
+}
+
+// text draws s with its baseline starting at x, y.
+func (d *pdfDoc) text(x, y float64, font string, size float64, s string) {
+	fmt.Fprintf(d.page, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, pageHeight-y, pdfString(s))
+}
+
+// textRight draws s in the monospaced font so that it ends at x.
+func (d *pdfDoc) textRight(x, y, size float64, s string) {
+	d.text(x-float64(len(s))*size*monoWidth, y, fontMono, size, s)
+}
+
+func (d *pdfDoc) line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(d.page, "%.2f %.2f m %.2f %.2f l S\n", x1, pageHeight-y1, x2, pageHeight-y2)
+}
+
+// dashed draws a dashed line, used for the perforations between a check
+// and its stubs.
+func (d *pdfDoc) dashed(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(d.page, "[4 4] 0 d\n")
+	d.line(x1, y1, x2, y2)
+	fmt.Fprintf(d.page, "[] 0 d\n")
+}
+
+func (d *pdfDoc) rect(x, y, w, h float64) {
+	fmt.Fprintf(d.page, "%.2f %.2f %.2f %.2f re S\n", x, pageHeight-y-h, w, h)
+}
+
+// bytes returns the finished document.
+func (d *pdfDoc) bytes() []byte {
+	var buf bytes.Buffer
+	offsets := []int{}
+	obj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+
+	// Objects 1 and 2 are the catalog and page tree, then the fonts, then
+	// a page and its content stream for each page.
+	fontBase := 3
+	pageBase := fontBase + len(pdfFonts)
+
+	kids := []string{}
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageBase+2*i))
+	}
+
+	fonts := []string{}
+	for i, f := range pdfFonts {
+		fonts = append(fonts, fmt.Sprintf("/%s %d 0 R", f.Name, fontBase+i))
+	}
+
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	for _, f := range pdfFonts {
+		obj(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", f.Base))
+	}
+
+	for i, p := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, strings.Join(fonts, " "), pageBase+2*i+1))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.Len(), p.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.Bytes()
+}
+
+// pdfString escapes s for a PDF string literal in WinAnsiEncoding.
+// Characters outside Latin-1 are printed as question marks.
+func pdfString(s string) string {
+	var b bytes.Buffer
+	for _, c := range s {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(byte(c))
+		case c < ' ':
+			b.WriteByte(' ')
+		case c < 0x80:
+			b.WriteByte(byte(c))
+		case c >= 0xa0 && c <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,251 @@
+package billing
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"appengine/datastore"
+)
+
+// Positive pay file formats.  Banks differ in the layout they accept, so
+// each company picks the one its bank uses.
+const (
+	PositivePayCSV   = "csv"
+	PositivePayFixed = "fixed"
+)
+
+type PositivePayFormat struct {
+	Value string
+	Label string
+}
+
+var positivePayFormats = []PositivePayFormat{
+	{PositivePayCSV, "CSV"},
+	{PositivePayFixed, "Fixed width"},
+}
+
+// positivePayDates are the issue date layouts banks ask for.
+var positivePayDates = []PositivePayFormat{
+	{"01022006", "MMDDYYYY"},
+	{"20060102", "YYYYMMDD"},
+	{"010206", "MMDDYY"},
+	{"01/02/2006", "MM/DD/YYYY"},
+	{"2006-01-02", "YYYY-MM-DD"},
+}
+
+// Positive pay record types.
+const (
+	positivePayIssue = "I"
+	positivePayVoid  = "V"
+)
+
+// PositivePaySettings is how a company's bank wants its positive pay files.
+// Header adds a row of column names to CSV files.
+type PositivePaySettings struct {
+	Format     string
+	DateLayout string
+	Header     bool
+}
+
+// PositivePayConfig returns the positive pay settings of the company, with
+// defaults for those it has not set.
+func (c *Company) PositivePayConfig() PositivePaySettings {
+	s := c.PositivePay
+	if s.Format == "" {
+		s.Format = PositivePayCSV
+	}
+	if s.DateLayout == "" {
+		s.DateLayout = positivePayDates[0].Value
+	}
+	return s
+}
+
+// validate returns a list of problems with the settings.  Settings left
+// empty use the defaults.
+func (s PositivePaySettings) validate() []string {
+	errs := []string{}
+	if s.Format != "" && !validPositivePayOption(positivePayFormats, s.Format) {
+		errs = append(errs, "You must select a valid positive pay format")
+	}
+	if s.DateLayout != "" && !validPositivePayOption(positivePayDates, s.DateLayout) {
+		errs = append(errs, "You must select a valid positive pay date format")
+	}
+	return errs
+}
+
+func validPositivePayOption(opts []PositivePayFormat, v string) bool {
+	for _, o := range opts {
+		if o.Value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// positivePayRecord is one check reported to the bank.
+type positivePayRecord struct {
+	Type     string
+	Account  string
+	CheckNum int
+	Amt      int
+	IssuedOn time.Time
+	Payee    string
+}
+
+// GeneratePositivePay returns the positive pay file of the check batch pb
+// in the format company c has configured.  It has an issue record for each
+// check that is not voided, or with voids set a void record for each voided
+// check.
+func GeneratePositivePay(c *Company, pb *PaymentBatch, voids bool) ([]byte, error) {
+	if !c.CanPrintChecks() {
+		return nil, fmt.Errorf("company %s has no bank account for checks", c.Name)
+	}
+
+	records := []positivePayRecord{}
+	for _, chk := range pb.Checks() {
+		if chk.Voided() != voids {
+			continue
+		}
+
+		typ := positivePayIssue
+		if voids {
+			typ = positivePayVoid
+		}
+
+		records = append(records, positivePayRecord{
+			Type:     typ,
+			Account:  c.Bank.AccountNumber,
+			CheckNum: chk.Num,
+			Amt:      chk.Amt,
+			IssuedOn: pb.EffectiveOn,
+			Payee:    chk.VendorName,
+		})
+	}
+
+	if len(records) == 0 {
+		return nil, BillStatusError("There are no checks to report")
+	}
+
+	s := c.PositivePayConfig()
+	if s.Format == PositivePayFixed {
+		return positivePayFixed(records, s), nil
+	}
+	return positivePayCSV(records, s)
+}
+
+func positivePayCSV(records []positivePayRecord, s PositivePaySettings) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	if s.Header {
+		w.Write([]string{"Account", "Check Number", "Amount", "Issue Date", "Payee", "Record Type"})
+	}
+
+	for _, r := range records {
+		w.Write([]string{
+			r.Account,
+			strconv.Itoa(r.CheckNum),
+			tmplMoney(r.Amt),
+			r.IssuedOn.Format(s.DateLayout),
+			r.Payee,
+			r.Type,
+		})
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// positivePayFixed writes records in the common fixed width layout: a 17
+// digit account number, 10 digit check number, 10 digit amount in cents,
+// issue date, record type and 50 character payee name.  Numbers are zero
+// filled and the payee is spelled in ASCII and space filled, as in NACHA
+// files, so every record has the same length in bytes.
+func positivePayFixed(records []positivePayRecord, s PositivePaySettings) []byte {
+	var buf bytes.Buffer
+	for _, r := range records {
+		account := r.Account
+		if len(account) > 17 {
+			account = account[len(account)-17:]
+		}
+
+		buf.WriteString(strings.Repeat("0", 17-len(account)) + account)
+		buf.WriteString(nachaNum(int64(r.CheckNum), 10))
+		buf.WriteString(nachaNum(int64(r.Amt), 10))
+		buf.WriteString(r.IssuedOn.Format(s.DateLayout))
+		buf.WriteString(r.Type)
+		buf.WriteString(nachaAlpha(asciiLatin.Replace(r.Payee), 50))
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+func handleAdminPositivePay(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	pb, err := ctx.GetPaymentBatchByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	if !pb.IsCheck() {
+		return datastore.ErrNoSuchEntity
+	}
+
+	voids := r.FormValue("voids") != ""
+	file, err := GeneratePositivePay(pb.Company, pb, voids)
+	if serr, ok := err.(BillStatusError); ok {
+		ctx.Flash("%s", serr.Error())
+		return ctx.Redirect("/admin/payments/view?id=" + pb.EncodedKey())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	name := pb.Reference + "-positive-pay"
+	if voids {
+		name += "-voids"
+	}
+
+	ext := ".csv"
+	contentType := "text/csv"
+	if pb.Company.PositivePayConfig().Format == PositivePayFixed {
+		ext = ".txt"
+		contentType = "text/plain"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename="+name+ext)
+	_, err = w.Write(file)
+	return err
+}
+
+func handleAdminVoidCheck(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	id := r.FormValue("id")
+	if r.Method != "POST" {
+		return ctx.Redirect("/admin/payments/view?id=" + id)
+	}
+
+	pb, err := ctx.GetPaymentBatchByID(id)
+	if err != nil {
+		return err
+	}
+
+	num := getFormFieldInt(r.Form, "check")
+	err = ctx.VoidCheck(pb, num, r.FormValue("reason"), r.FormValue("justification"))
+	if serr, ok := err.(BillStatusError); ok {
+		ctx.Flash("%s", serr.Error())
+		return ctx.Redirect("/admin/payments/view?id=" + id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Check %d voided. Send the bank the void records.", num)
+	return ctx.Redirect("/admin/payments/view?id=" + id)
+}
@@ -0,0 +1,215 @@
+package billing
+
+import (
+	"net/http"
+
+	"appengine/datastore"
+)
+
+// Roles a user can hold within their company.
+const (
+	RoleViewer       = "viewer"
+	RoleSubmitter    = "submitter"
+	RoleApprover     = "approver"
+	RolePayer        = "payer"
+	RoleCompanyAdmin = "company_admin"
+)
+
+// Permissions checked by permissionOnly and the templates.
+const (
+	PermViewBills      = "view_bills"
+	PermSubmitBills    = "submit_bills"
+	PermApproveBills   = "approve_bills"
+	PermPayBills       = "pay_bills"
+	PermReconcileBills = "reconcile_bills"
+	PermManageUsers    = "manage_users"
+)
+
+type Role struct {
+	Value       string
+	Label       string
+	Permissions []string
+}
+
+var roles = []Role{
+	{RoleViewer, "Viewer", []string{PermViewBills}},
+	{RoleSubmitter, "Submitter", []string{PermViewBills, PermSubmitBills}},
+	{RoleApprover, "Approver", []string{PermViewBills, PermApproveBills}},
+	{RolePayer, "Payer", []string{PermViewBills, PermPayBills, PermReconcileBills}},
+	{RoleCompanyAdmin, "Company Admin", []string{
+		PermViewBills,
+		PermSubmitBills,
+		PermApproveBills,
+		PermPayBills,
+		PermReconcileBills,
+		PermManageUsers,
+	}},
+}
+
+func findRole(value string) (Role, bool) {
+	for _, r := range roles {
+		if r.Value == value {
+			return r, true
+		}
+	}
+	return Role{}, false
+}
+
+// validRoles returns the known roles in values, in the order of roles.
+func validRoles(values []string) []string {
+	valid := []string{}
+	for _, r := range roles {
+		for _, v := range values {
+			if v == r.Value {
+				valid = append(valid, r.Value)
+				break
+			}
+		}
+	}
+	return valid
+}
+
+// effectiveRoles returns the roles of u.  Users created before roles existed
+// have none stored and keep the full access they had as company admins.
+func (u *User) effectiveRoles() []string {
+	if len(u.Roles) == 0 {
+		return []string{RoleCompanyAdmin}
+	}
+	return u.Roles
+}
+
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.effectiveRoles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether any of the user's roles grants perm.
+func (u *User) Can(perm string) bool {
+	for _, value := range u.effectiveRoles() {
+		r, ok := findRole(value)
+		if !ok {
+			continue
+		}
+		for _, p := range r.Permissions {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (u *User) RoleLabels() []string {
+	labels := []string{}
+	for _, value := range u.effectiveRoles() {
+		if r, ok := findRole(value); ok {
+			labels = append(labels, r.Label)
+		}
+	}
+	return labels
+}
+
+// Can reports whether the current user has perm.  App Engine admins can do
+// everything.
+func (ctx *Context) Can(perm string) bool {
+	if ctx.admin {
+		return true
+	}
+
+	if ctx.userSession == nil || ctx.userSession.User == nil {
+		return false
+	}
+
+	return ctx.userSession.User.Can(perm)
+}
+
+// permissionOnly is authOnly followed by a check that the user's company
+// role grants perm.
+func permissionOnly(perm string, next myHandler) myHandler {
+	return authOnly(func(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+		if !ctx.Can(perm) {
+			ctx.Flash("You do not have permission to do that.")
+			return ctx.Redirect("/bills/dashboard")
+		}
+
+		return next(ctx, w, r)
+	})
+}
+
+// Permissions returns the permissions of the current user so templates can
+// hide the actions the user cannot take.
+func (ctx *Context) Permissions() map[string]bool {
+	perms := map[string]bool{}
+	for _, r := range roles {
+		for _, p := range r.Permissions {
+			if ctx.Can(p) {
+				perms[p] = true
+			}
+		}
+	}
+	return perms
+}
+
+type CompanyUsersPage struct {
+	Company *Company
+	Users   []*User
+	Roles   []Role
+	Pager   *Pager
+}
+
+func handleCompanyUsers(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	company := ctx.userSession.Company
+	p := NewPager(r.URL.Query(), "", 20)
+	users, err := ctx.GetCompanyUsers(company, p)
+	if err != nil {
+		return err
+	}
+
+	ctx.SetTitle(company.Name + " Users")
+
+	return ctx.Render(usersTmpl, CompanyUsersPage{company, users, roles, p})
+}
+
+// handleCompanyUserRoles lets company admins change the roles of the other
+// users of their company.
+func handleCompanyUserRoles(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return ctx.Redirect("/bills/users")
+	}
+
+	u, err := ctx.GetUserByID(r.FormValue("id"))
+	if u.Key == nil {
+		return datastore.ErrNoSuchEntity
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if u.CompanyKey == nil || !u.CompanyKey.Equal(ctx.userSession.Company.Key) {
+		return datastore.ErrNoSuchEntity
+	}
+
+	if u.Key.Equal(ctx.userSession.User.Key) {
+		ctx.Flash("You cannot change your own roles.")
+		return ctx.Redirect("/bills/users")
+	}
+
+	userRoles := validRoles(r.Form["roles"])
+	if len(userRoles) == 0 {
+		ctx.Flash("Users must have at least one role.")
+		return ctx.Redirect("/bills/users")
+	}
+
+	err = ctx.SetUserRoles(u, userRoles)
+	if err != nil {
+		return err
+	}
+
+	ctx.Flash("Roles updated for %s", u.Email)
+	return ctx.Redirect("/bills/users")
+}
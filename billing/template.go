@@ -3,14 +3,16 @@ package billing
 import (
 	"fmt"
 	"html/template"
+	"os"
 	"path/filepath"
 	"time"
 )
 
 var tmplFuncMap = template.FuncMap{
-	"date":  tmplDate,
-	"time":  tmplTime,
-	"money": tmplMoney,
+	"date":     tmplDate,
+	"time":     tmplTime,
+	"money":    tmplMoney,
+	"formDate": tmplFormDate,
 }
 
 var tmplAdminFuncMap = template.FuncMap{
@@ -19,22 +21,40 @@ var tmplAdminFuncMap = template.FuncMap{
 	"sidebarLink":          tmplSidebarLink,
 	"sidebarLinkWithCount": tmplSidebarLinkWithCount,
 	"money":                tmplMoney,
+	"formDate":             tmplFormDate,
+}
+
+// tmplDir is where the templates are: under the app root, which is the
+// working directory when the app runs, or one level up when the package
+// tests run in the billing directory.
+var tmplDir = findTmplDir()
+
+func findTmplDir() string {
+	if _, err := os.Stat("tmpl"); err != nil {
+		return filepath.Join("..", "tmpl")
+	}
+	return "tmpl"
 }
 
 func adminTmpl(p string) *template.Template {
-	path := filepath.Join("./tmpl/admin", p)
 	templates := []string{
-		"./tmpl/admin/layout.html",
-		path,
-		"./tmpl/_user_menu.html",
-		"./tmpl/admin/_menu.html",
+		filepath.Join(tmplDir, "admin/layout.html"),
+		filepath.Join(tmplDir, "admin", p),
+		filepath.Join(tmplDir, "_user_menu.html"),
+		filepath.Join(tmplDir, "admin/_menu.html"),
+		filepath.Join(tmplDir, "admin/_vendor_details.html"),
+		filepath.Join(tmplDir, "_pager.html"),
 	}
 	return template.Must(template.New("layout.html").Funcs(tmplAdminFuncMap).ParseFiles(templates...))
 }
 
 func tmpl(p string) *template.Template {
-	path := filepath.Join("./tmpl", p)
-	return template.Must(template.New("layout.html").Funcs(tmplFuncMap).ParseFiles("./tmpl/layout.html", path))
+	templates := []string{
+		filepath.Join(tmplDir, "layout.html"),
+		filepath.Join(tmplDir, p),
+		filepath.Join(tmplDir, "_pager.html"),
+	}
+	return template.Must(template.New("layout.html").Funcs(tmplFuncMap).ParseFiles(templates...))
 }
 
 func tmplDate(date time.Time) string {
@@ -73,3 +93,11 @@ func tmplMoney(v int) string {
 	f := float64(v) / 100.0
 	return fmt.Sprintf("%0.2f", f)
 }
+
+func tmplFormDate(date time.Time) string {
+	if date.IsZero() {
+		return ""
+	}
+
+	return date.Format(formDateLayout)
+}
@@ -0,0 +1,109 @@
+package billing
+
+import (
+	"time"
+)
+
+// PaymentTerms describes when a vendor expects to be paid and any discount
+// offered for paying early.  DiscountBps is in basis points, so "2/10 Net 30"
+// is a 200 basis point discount if paid within 10 days, otherwise due in 30.
+type PaymentTerms struct {
+	Code         string
+	Label        string
+	NetDays      int
+	EndOfMonth   bool
+	DiscountBps  int
+	DiscountDays int
+}
+
+const defaultTermsCode = "net30"
+
+var paymentTerms = []PaymentTerms{
+	{Code: "receipt", Label: "Due on receipt"},
+	{Code: "net15", Label: "Net 15", NetDays: 15},
+	{Code: "net30", Label: "Net 30", NetDays: 30},
+	{Code: "net60", Label: "Net 60", NetDays: 60},
+	{Code: "2_10_net30", Label: "2/10 Net 30", NetDays: 30, DiscountBps: 200, DiscountDays: 10},
+	{Code: "eom", Label: "End of month", EndOfMonth: true},
+}
+
+// discountClosingDays is how close to its discount deadline a bill must be
+// before it is flagged in the bills list.
+const discountClosingDays = 3
+
+func findPaymentTerms(code string) (PaymentTerms, bool) {
+	for _, t := range paymentTerms {
+		if t.Code == code {
+			return t, true
+		}
+	}
+	return PaymentTerms{}, false
+}
+
+// DueDate returns the date a bill with the given invoice date is due.
+func (t PaymentTerms) DueDate(invoiceDate time.Time) time.Time {
+	if t.EndOfMonth {
+		y, m, _ := invoiceDate.Date()
+		return time.Date(y, m+1, 0, 0, 0, 0, 0, invoiceDate.Location())
+	}
+	return invoiceDate.AddDate(0, 0, t.NetDays)
+}
+
+// Discount returns the last day the early payment discount can be taken and
+// the discount in cents on amt.  It returns a zero time if the terms have no
+// discount.
+func (t PaymentTerms) Discount(invoiceDate time.Time, amt int) (time.Time, int) {
+	if t.DiscountBps == 0 {
+		return time.Time{}, 0
+	}
+	return invoiceDate.AddDate(0, 0, t.DiscountDays), (amt*t.DiscountBps + 5000) / 10000
+}
+
+// applyTerms records the vendor terms on the bill, fills in the due date if
+// one was not entered and computes any early payment discount.
+func (b *Bill) applyTerms(code string) {
+	t, ok := findPaymentTerms(code)
+	if !ok || b.Date.IsZero() {
+		return
+	}
+
+	b.Terms = t.Code
+	if b.DueOn.IsZero() {
+		b.DueOn = t.DueDate(b.Date)
+	}
+	b.DiscountBy, b.DiscountAmt = t.Discount(b.Date, b.Amt)
+}
+
+func (b *Bill) TermsLabel() string {
+	if t, ok := findPaymentTerms(b.Terms); ok {
+		return t.Label
+	}
+	return b.Terms
+}
+
+// discountAppliesOn reports whether a payment made on day d is early enough
+// to take the discount.
+func (b *Bill) discountAppliesOn(d time.Time) bool {
+	return b.DiscountAmt > 0 && !b.DiscountBy.IsZero() && !d.After(b.DiscountBy)
+}
+
+// DiscountAvailable reports whether the bill can still be settled at the
+// discounted amount.
+func (b *Bill) DiscountAvailable() bool {
+	return !b.Paid && b.discountAppliesOn(today())
+}
+
+// DiscountClosing reports whether the discount is still available but will
+// expire within discountClosingDays.
+func (b *Bill) DiscountClosing() bool {
+	return b.DiscountAvailable() && b.DiscountBy.Before(today().AddDate(0, 0, discountClosingDays+1))
+}
+
+// AmountDue returns what must be paid today to settle the bill, taking the
+// early payment discount if it is still available.
+func (b *Bill) AmountDue() int {
+	if b.DiscountAvailable() {
+		return b.Balance() - b.DiscountAmt
+	}
+	return b.Balance()
+}
@@ -0,0 +1,492 @@
+package billing
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+)
+
+// trashRetention is how long deleted entities stay in the trash before they
+// can be purged.
+const trashRetention = 30 * 24 * time.Hour
+
+// trashKinds are the kinds that are moved to the trash instead of being
+// deleted, in the order they are listed and purged.  Children come before
+// their company so a company is only purged once they are gone.
+var trashKinds = []string{"Bill", "Vendor", "User", "Company"}
+
+// companyDataKinds are the kinds under a company that are not moved to the
+// trash on their own.  They are deleted when the company is purged.
+var companyDataKinds = []string{"PaymentBatch", "Offboarding", "BankChange", "AuditEvent"}
+
+// purgeBatchSize is how many entities are deleted at a time when a company
+// is purged.
+const purgeBatchSize = 500
+
+// trashFields returns the deletion fields of a Company, User, Vendor or
+// Bill.  deleted is nil for any other value.
+func trashFields(v interface{}) (deleted *bool, on *time.Time, by *string) {
+	switch e := v.(type) {
+	case *Company:
+		return &e.Deleted, &e.DeletedOn, &e.DeletedBy
+	case *User:
+		return &e.Deleted, &e.DeletedOn, &e.DeletedBy
+	case *Vendor:
+		return &e.Deleted, &e.DeletedOn, &e.DeletedBy
+	case *Bill:
+		return &e.Deleted, &e.DeletedOn, &e.DeletedBy
+	}
+	return nil, nil, nil
+}
+
+// notDeleted is a getPageWhere match for entities that are not in the trash.
+// Entities stored before soft deletes have no Deleted property, so deleted
+// entities are skipped in memory rather than with a query filter.
+func notDeleted(v interface{}) bool {
+	deleted, _, _ := trashFields(v)
+	return deleted == nil || !*deleted
+}
+
+// newTrashEntity returns a pointer to a new entity of kind.
+func newTrashEntity(kind string) (interface{}, error) {
+	switch kind {
+	case "Company":
+		return new(Company), nil
+	case "User":
+		return new(User), nil
+	case "Vendor":
+		return new(Vendor), nil
+	case "Bill":
+		return new(Bill), nil
+	}
+	return nil, fmt.Errorf("%s entities cannot be moved to the trash", kind)
+}
+
+// countActive counts the entities of kind that are not in the trash.
+func (ctx *Context) countActive(kind string) (int, error) {
+	total, err := datastore.NewQuery(kind).Count(ctx.c)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := datastore.NewQuery(kind).Filter("Deleted =", true).Count(ctx.c)
+	if err != nil {
+		return 0, err
+	}
+
+	return total - deleted, nil
+}
+
+// hasActive reports whether q returns any entity that is not in the trash.
+// q must be a query for a Company, User, Vendor or Bill kind.
+func hasActive(c appengine.Context, q *datastore.Query, kind string) (bool, error) {
+	t := q.Run(c)
+	for {
+		dst, err := newTrashEntity(kind)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = t.Next(dst)
+		if err == datastore.Done {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if notDeleted(dst) {
+			return true, nil
+		}
+	}
+}
+
+// moveToTrash marks the entity at key deleted by the current user.  If
+// check is not nil it is called in the same transaction with the loaded
+// entity and may refuse the delete.  Entities already in the trash are
+// reported as datastore.ErrNoSuchEntity.
+func (ctx *Context) moveToTrash(key *datastore.Key, check func(c appengine.Context, v interface{}) error) error {
+	return datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		v, err := newTrashEntity(key.Kind())
+		if err != nil {
+			return err
+		}
+
+		err = datastore.Get(c, key, v)
+		if err != nil {
+			return err
+		}
+
+		deleted, _, _ := trashFields(v)
+		if *deleted {
+			return datastore.ErrNoSuchEntity
+		}
+
+		if check != nil {
+			err = check(c, v)
+			if err != nil {
+				return err
+			}
+		}
+
+		return ctx.trashEntity(c, key, v)
+	}, nil)
+}
+
+// trashEntity marks v, the entity stored at key, deleted by the current user
+// and stores it.  It must be called in a transaction.
+func (ctx *Context) trashEntity(c appengine.Context, key *datastore.Key, v interface{}) error {
+	deleted, on, by := trashFields(v)
+	before := reflect.Indirect(reflect.ValueOf(v)).Interface()
+	*deleted = true
+	*on = time.Now()
+	*by = ctx.user.String()
+
+	_, err := datastore.Put(c, key, v)
+	if err != nil {
+		return err
+	}
+
+	return ctx.recordAudit(c, AuditDelete, key, before, v)
+}
+
+// RestoreFromTrash takes the entity at key back out of the trash.  Users,
+// vendors and bills cannot be restored while their company is in the trash,
+// nor bills while their vendor is.
+func (ctx *Context) RestoreFromTrash(key *datastore.Key) error {
+	return datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		v, err := newTrashEntity(key.Kind())
+		if err != nil {
+			return err
+		}
+
+		err = datastore.Get(c, key, v)
+		if err != nil {
+			return err
+		}
+
+		deleted, on, by := trashFields(v)
+		if !*deleted {
+			return InUseError("This item is not in the trash.")
+		}
+
+		// Bills uploaded before there were companies have no parent and no
+		// company to check.
+		if key.Kind() != "Company" && key.Parent() != nil {
+			company := new(Company)
+			err = datastore.Get(c, key.Parent(), company)
+			if err != nil {
+				return err
+			}
+
+			if company.Deleted {
+				return InUseError("Restore the company " + company.Name + " first.")
+			}
+		}
+
+		if b, ok := v.(*Bill); ok && b.VendorKey != nil {
+			vendor := new(Vendor)
+			err = datastore.Get(c, b.VendorKey, vendor)
+			if err != nil {
+				return err
+			}
+
+			if vendor.Deleted {
+				return InUseError("Restore the vendor " + vendor.Name + " first.")
+			}
+		}
+
+		before := reflect.Indirect(reflect.ValueOf(v)).Interface()
+		*deleted = false
+		*on = time.Time{}
+		*by = ""
+
+		_, err = datastore.Put(c, key, v)
+		if err != nil {
+			return err
+		}
+
+		return ctx.recordAudit(c, AuditRestore, key, before, v)
+	}, nil)
+}
+
+// checkPurge returns an InUseError if the entity v at key cannot be purged
+// yet.  It must be called inside a transaction.
+func checkPurge(c appengine.Context, key *datastore.Key, v interface{}) error {
+	deleted, on, _ := trashFields(v)
+	if !*deleted {
+		return InUseError("Only items in the trash can be purged.")
+	}
+
+	if time.Since(*on) < trashRetention {
+		return InUseError("Items can only be purged " + fmt.Sprint(int(trashRetention.Hours()/24)) + " days after they are deleted.")
+	}
+
+	switch v.(type) {
+	case *Company:
+		for _, kind := range []string{"User", "Vendor", "Bill"} {
+			found, err := datastore.NewQuery(kind).Ancestor(key).KeysOnly().Limit(1).GetAll(c, nil)
+			if err != nil {
+				return err
+			}
+
+			if len(found) > 0 {
+				return InUseError("Purge the users, vendors and bills of the company first.")
+			}
+		}
+	case *Vendor:
+		q := datastore.NewQuery("Bill").Ancestor(key.Parent()).Filter("VendorKey =", key).KeysOnly().Limit(1)
+		found, err := q.GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+
+		if len(found) > 0 {
+			return InUseError("Purge the bills of the vendor first.")
+		}
+	}
+
+	return nil
+}
+
+// purgeCompanyData deletes the payment batches, offboarding, bank changes
+// and audit log of the company at key, purgeBatchSize at a time since there
+// can be more of them than one transaction can delete.  The company must
+// already be purgeable.
+func (ctx *Context) purgeCompanyData(key *datastore.Key) error {
+	err := datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		company := new(Company)
+		err := datastore.Get(c, key, company)
+		if err != nil {
+			return err
+		}
+		return checkPurge(c, key, company)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, kind := range companyDataKinds {
+		for {
+			keys, err := datastore.NewQuery(kind).Ancestor(key).KeysOnly().Limit(purgeBatchSize).GetAll(ctx.c, nil)
+			if err != nil {
+				return err
+			}
+
+			if len(keys) == 0 {
+				break
+			}
+
+			err = datastore.DeleteMulti(ctx.c, keys)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// PurgeFromTrash permanently deletes the entity at key once it has been in
+// the trash for trashRetention.  Purging a bill also deletes its history,
+// payment records and files, and purging a company its payment batches,
+// offboarding, bank changes and audit log, leaving only the record of the
+// purge.  Companies and vendors are only purged once nothing refers to
+// them, not even entities still in the trash.
+func (ctx *Context) PurgeFromTrash(key *datastore.Key) error {
+	var blobs []appengine.BlobKey
+
+	if key.Kind() == "Company" {
+		err := ctx.purgeCompanyData(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		blobs = nil
+
+		v, err := newTrashEntity(key.Kind())
+		if err != nil {
+			return err
+		}
+
+		err = datastore.Get(c, key, v)
+		if err != nil {
+			return err
+		}
+
+		err = checkPurge(c, key, v)
+		if err != nil {
+			return err
+		}
+
+		keys := []*datastore.Key{key}
+
+		if e, ok := v.(*Bill); ok {
+			eventKeys, err := datastore.NewQuery("BillEvent").Ancestor(key).KeysOnly().GetAll(c, nil)
+			if err != nil {
+				return err
+			}
+
+			var payments []*Payment
+			paymentKeys, err := datastore.NewQuery("Payment").Ancestor(key).GetAll(c, &payments)
+			if err != nil {
+				return err
+			}
+
+			keys = append(append(keys, eventKeys...), paymentKeys...)
+
+			if e.BlobKey != "" {
+				blobs = append(blobs, e.BlobKey)
+			}
+			for _, p := range payments {
+				if p.ProofBlobKey != "" {
+					blobs = append(blobs, p.ProofBlobKey)
+				}
+			}
+		}
+
+		err = datastore.DeleteMulti(c, keys)
+		if err != nil {
+			return err
+		}
+
+		return ctx.recordAudit(c, AuditPurge, key, v, nil)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, blobKey := range blobs {
+		err := blobstore.Delete(ctx.c, blobKey)
+		if err != nil {
+			ctx.c.Errorf("could not delete file %s of %v: %v", blobKey, key, err)
+		}
+	}
+
+	return nil
+}
+
+// TrashItem is one deleted entity shown on the trash page.
+type TrashItem struct {
+	Key       *datastore.Key
+	Kind      string
+	Name      string
+	DeletedOn time.Time
+	DeletedBy string
+}
+
+func (t *TrashItem) EncodedKey() string {
+	return t.Key.Encode()
+}
+
+func (t *TrashItem) PurgeOn() time.Time {
+	return t.DeletedOn.Add(trashRetention)
+}
+
+func (t *TrashItem) CanPurge() bool {
+	return !time.Now().Before(t.PurgeOn())
+}
+
+type trashItems []*TrashItem
+
+func (t trashItems) Len() int           { return len(t) }
+func (t trashItems) Less(i, j int) bool { return t[i].DeletedOn.After(t[j].DeletedOn) }
+func (t trashItems) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+func trashName(v interface{}) string {
+	switch e := v.(type) {
+	case *Company:
+		return e.Name
+	case *User:
+		return e.Email
+	case *Vendor:
+		return e.Name
+	case *Bill:
+		return fmt.Sprintf("Invoice %s for %s", e.InvoiceNum, tmplMoney(e.Amt))
+	}
+	return ""
+}
+
+// GetTrash returns every entity in the trash, most recently deleted first.
+func (ctx *Context) GetTrash() ([]*TrashItem, error) {
+	items := []*TrashItem{}
+
+	for _, kind := range trashKinds {
+		t := datastore.NewQuery(kind).Filter("Deleted =", true).Run(ctx.c)
+		for {
+			v, err := newTrashEntity(kind)
+			if err != nil {
+				return items, err
+			}
+
+			k, err := t.Next(v)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return items, err
+			}
+
+			_, on, by := trashFields(v)
+			items = append(items, &TrashItem{k, kind, trashName(v), *on, *by})
+		}
+	}
+
+	sort.Sort(trashItems(items))
+	return items, nil
+}
+
+type TrashPage struct {
+	Items     []*TrashItem
+	Retention int
+}
+
+func handleAdminTrash(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	items, err := ctx.GetTrash()
+	if err != nil {
+		return err
+	}
+
+	return ctx.renderAdmin(trashTmpl, TrashPage{items, int(trashRetention.Hours() / 24)})
+}
+
+func handleAdminTrashAction(restore bool) myHandler {
+	return func(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "POST" {
+			return ctx.Redirect("/admin/trash")
+		}
+
+		key, err := datastore.DecodeKey(r.FormValue("id"))
+		if err != nil {
+			return datastore.ErrNoSuchEntity
+		}
+
+		msg := "Item purged"
+		if restore {
+			msg = "Item restored"
+			err = ctx.RestoreFromTrash(key)
+		} else {
+			err = ctx.PurgeFromTrash(key)
+		}
+
+		if ierr, ok := err.(InUseError); ok {
+			ctx.Flash("%s", ierr.Error())
+			return ctx.Redirect("/admin/trash")
+		}
+
+		if err != nil {
+			return err
+		}
+
+		ctx.Flash("%s", msg)
+		return ctx.Redirect("/admin/trash")
+	}
+}
@@ -10,17 +10,21 @@ type User struct {
 	Key         *datastore.Key `datastore:"-"`
 	Email       string
 	CompanyKey  *datastore.Key
+	Roles       []string
 	LastLoginOn time.Time
 	CreatedOn   time.Time
 	CreatedBy   string
+	Deleted     bool
+	DeletedOn   time.Time
+	DeletedBy   string
 	Company     *Company `datastore:"-"`
 }
 
-func (ctx *Context) GetAllUsers() ([]*User, error) {
+func (ctx *Context) GetAllUsers(p *Pager) ([]*User, error) {
 	var users []*User
-	q := datastore.NewQuery("User").Order("-LastLoginOn").Limit(10)
+	q := datastore.NewQuery("User").Order("-LastLoginOn")
 	users = make([]*User, 0, 10)
-	keys, err := q.GetAll(ctx.c, &users)
+	keys, err := ctx.getPageWhere(q, p, &users, notDeleted)
 	if err != nil {
 		return users, err
 	}
@@ -33,12 +37,12 @@ func (ctx *Context) GetAllUsers() ([]*User, error) {
 	return users, nil
 }
 
-func (ctx *Context) GetCompanyUsers(c *Company) ([]*User, error) {
+func (ctx *Context) GetCompanyUsers(c *Company, p *Pager) ([]*User, error) {
 
 	var users []*User
-	q := datastore.NewQuery("User").Ancestor(c.Key).Order("Email").Limit(20)
+	q := datastore.NewQuery("User").Ancestor(c.Key).Order("Email")
 	users = make([]*User, 0, 20)
-	keys, err := q.GetAll(ctx.c, &users)
+	keys, err := ctx.getPageWhere(q, p, &users, notDeleted)
 	if err != nil {
 		return users, err
 	}
@@ -51,6 +55,8 @@ func (ctx *Context) GetCompanyUsers(c *Company) ([]*User, error) {
 	return users, nil
 }
 
+// UserEmailExists reports whether a user has the email e, counting users in
+// the trash, who would be restored rather than created again.
 func (ctx *Context) UserEmailExists(e string) (bool, error) {
 	q := datastore.NewQuery("User").Filter("Email =", e)
 	cnt, err := q.Count(ctx.c)
@@ -70,16 +76,22 @@ func (ctx *Context) GetUserAndCompanyByEmail(e string) (*User, *Company, error)
 	users := make([]*User, 0, 1)
 	q := datastore.NewQuery("User").Filter("Email =", e).Limit(1)
 	keys, err := q.GetAll(ctx.c, &users)
-	if err != nil || len(keys) == 0 {
+	if err != nil || len(keys) == 0 || users[0].Deleted {
 		return nil, nil, err
 	}
 
+	users[0].ID = keys[0].Encode()
+	users[0].Key = keys[0]
+
 	company := new(Company)
 	err = datastore.Get(ctx.c, users[0].CompanyKey, company)
-	if err != nil {
+	if err != nil || company.Deleted {
 		return nil, nil, err
 	}
 
+	company.ID = users[0].CompanyKey.Encode()
+	company.Key = users[0].CompanyKey
+
 	return users[0], company, err
 }
 
@@ -87,6 +99,7 @@ func (ctx *Context) GetUserByID(id string) (*User, error) {
 	user := new(User)
 	k, err := datastore.DecodeKey(id)
 
+	user.ID = id
 	user.Key = k
 
 	if err != nil {
@@ -117,6 +130,7 @@ func (ctx *Context) LoadUserCompanies(users []*User) error {
 	return nil
 }
 
+// DeleteUser moves the user with the encoded key id to the trash.
 func (ctx *Context) DeleteUser(id string) error {
 	k, err := datastore.DecodeKey(id)
 
@@ -124,12 +138,17 @@ func (ctx *Context) DeleteUser(id string) error {
 		return err
 	}
 
-	err = datastore.Delete(ctx.c, k)
-
-	return err
+	return ctx.moveToTrash(k, nil)
 }
 
 func (ctx *Context) GetUserCount() (int, error) {
-	c, err := datastore.NewQuery("User").Count(ctx.c)
-	return c, err
+	return ctx.countActive("User")
+}
+
+// SetUserRoles replaces the roles of u.
+func (ctx *Context) SetUserRoles(u *User, roles []string) error {
+	before := *u
+	u.Roles = roles
+	_, err := ctx.putAudited(u.Key, &before, u)
+	return err
 }
@@ -1,6 +1,7 @@
 package billing
 
 import (
+	"appengine"
 	"appengine/datastore"
 	"time"
 )
@@ -10,16 +11,43 @@ type Vendor struct {
 	Key        *datastore.Key `datastore:"-"`
 	CompanyKey *datastore.Key
 	Name       string
-	CreatedOn  time.Time
-	CreatedBy  string
-	Company    *Company `datastore:"-"`
+	Terms      string
+
+	// Contact, remittance and payment details.  ExpenseCategory is the
+	// default category the vendor's bills are booked to and PaymentMethod
+	// how the vendor prefers to be paid.
+	Email           string
+	Phone           string
+	RemitTo         Address
+	TaxID           string
+	ExpenseCategory string
+	PaymentMethod   string
+	Bank            BankAccount
+
+	// BankChangePending is set while a change to Bank waits to be
+	// confirmed.  Payments to the vendor are held until then.
+	BankChangePending bool
+
+	CreatedOn time.Time
+	CreatedBy string
+	Deleted   bool
+	DeletedOn time.Time
+	DeletedBy string
+	Company   *Company `datastore:"-"`
 }
 
-func (ctx *Context) GetAllVendors() ([]*Vendor, error) {
+func (v *Vendor) TermsLabel() string {
+	if t, ok := findPaymentTerms(v.Terms); ok {
+		return t.Label
+	}
+	return v.Terms
+}
+
+func (ctx *Context) GetAllVendors(p *Pager) ([]*Vendor, error) {
 	var vendors []*Vendor
-	q := datastore.NewQuery("Vendor").Order("Name").Limit(10)
+	q := datastore.NewQuery("Vendor").Order("Name")
 	vendors = make([]*Vendor, 0, 10)
-	keys, err := q.GetAll(ctx.c, &vendors)
+	keys, err := ctx.getPageWhere(q, p, &vendors, notDeleted)
 	if err != nil {
 		return vendors, err
 	}
@@ -32,12 +60,12 @@ func (ctx *Context) GetAllVendors() ([]*Vendor, error) {
 	return vendors, nil
 }
 
-func (ctx *Context) GetCompanyVendors(c *Company) ([]*Vendor, error) {
+func (ctx *Context) GetCompanyVendors(c *Company, p *Pager) ([]*Vendor, error) {
 
 	var vendors []*Vendor
-	q := datastore.NewQuery("Vendor").Ancestor(c.Key).Order("Name").Limit(20)
+	q := datastore.NewQuery("Vendor").Ancestor(c.Key).Order("Name")
 	vendors = make([]*Vendor, 0, 20)
-	keys, err := q.GetAll(ctx.c, &vendors)
+	keys, err := ctx.getPageWhere(q, p, &vendors, notDeleted)
 	if err != nil {
 		return vendors, err
 	}
@@ -85,6 +113,7 @@ func (ctx *Context) GetVendorByID(id string) (*Vendor, error) {
 	v := new(Vendor)
 	k, err := datastore.DecodeKey(id)
 
+	v.ID = id
 	v.Key = k
 
 	if err != nil {
@@ -97,6 +126,60 @@ func (ctx *Context) GetVendorByID(id string) (*Vendor, error) {
 }
 
 func (ctx *Context) GetVendorCount() (int, error) {
-	c, err := datastore.NewQuery("Vendor").Count(ctx.c)
-	return c, err
+	return ctx.countActive("Vendor")
+}
+
+// UpdateVendor stores the name, terms and details of src on the vendor at
+// key.  A change to the bank details is held as a BankChange until another
+// user confirms it.
+func (ctx *Context) UpdateVendor(key *datastore.Key, src *Vendor) error {
+	return datastore.RunInTransaction(ctx.c, func(c appengine.Context) error {
+		v := new(Vendor)
+		err := datastore.Get(c, key, v)
+		if err != nil {
+			return err
+		}
+
+		before := *v
+		v.Name = src.Name
+		v.Terms = src.Terms
+		v.Email = src.Email
+		v.Phone = src.Phone
+		v.RemitTo = src.RemitTo
+		v.TaxID = src.TaxID
+		v.ExpenseCategory = src.ExpenseCategory
+		v.PaymentMethod = src.PaymentMethod
+
+		if src.Bank != v.Bank {
+			err = ctx.requestBankChange(c, key, v, src.Bank)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = datastore.Put(c, key, v)
+		if err != nil {
+			return err
+		}
+
+		return ctx.recordAudit(c, AuditUpdate, key, &before, v)
+	}, nil)
+}
+
+// DeleteVendor moves the vendor at key to the trash.  Vendors that still
+// have bills are not deleted.
+func (ctx *Context) DeleteVendor(key *datastore.Key) error {
+	return ctx.moveToTrash(key, func(c appengine.Context, v interface{}) error {
+		q := datastore.NewQuery("Bill").Ancestor(key.Parent()).Filter("VendorKey =", key)
+		found, err := hasActive(c, q, "Bill")
+		if err != nil {
+			return err
+		}
+
+		if found {
+			return InUseError("The vendor still has bills. Delete or move them before deleting the vendor.")
+		}
+
+		return nil
+	})
 }
@@ -0,0 +1,321 @@
+package billing
+
+import (
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Address is a postal address.  Country is an ISO 3166 two letter code;
+// State and PostalCode are checked for US addresses only.
+type Address struct {
+	Line1      string
+	Line2      string
+	City       string
+	State      string
+	PostalCode string
+	Country    string
+}
+
+func (a Address) IsZero() bool {
+	return a == Address{}
+}
+
+// Lines returns the address formatted for an envelope.
+func (a Address) Lines() []string {
+	lines := []string{}
+	for _, l := range []string{a.Line1, a.Line2} {
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+
+	last := a.City
+	if a.State != "" {
+		if last != "" {
+			last += ", "
+		}
+		last += a.State
+	}
+	if a.PostalCode != "" {
+		last = strings.TrimSpace(last + " " + a.PostalCode)
+	}
+	if last != "" {
+		lines = append(lines, last)
+	}
+
+	if a.Country != "" && a.Country != "US" {
+		lines = append(lines, a.Country)
+	}
+	return lines
+}
+
+// BankAccount holds the details needed to pay a vendor electronically.  US
+// accounts use RoutingNumber and AccountNumber; international accounts use
+// IBAN and BIC.
+type BankAccount struct {
+	BankName      string
+	AccountName   string
+	AccountType   string
+	RoutingNumber string
+	AccountNumber string
+	IBAN          string
+	BIC           string
+}
+
+func (b BankAccount) IsZero() bool {
+	return b == BankAccount{}
+}
+
+// MaskedAccount returns the account number or IBAN with all but the last
+// four characters hidden, for display.
+func (b BankAccount) MaskedAccount() string {
+	n := b.AccountNumber
+	if n == "" {
+		n = b.IBAN
+	}
+	if len(n) <= 4 {
+		return n
+	}
+	return strings.Repeat("*", len(n)-4) + n[len(n)-4:]
+}
+
+// Bank account types.
+const (
+	AccountChecking = "checking"
+	AccountSavings  = "savings"
+)
+
+type AccountType struct {
+	Value string
+	Label string
+}
+
+var accountTypes = []AccountType{
+	{AccountChecking, "Checking"},
+	{AccountSavings, "Savings"},
+}
+
+// ExpenseCategory is the default category bills of a vendor are booked to.
+type ExpenseCategory struct {
+	Code  string
+	Label string
+}
+
+var expenseCategories = []ExpenseCategory{
+	{"cogs", "Cost of goods sold"},
+	{"rent", "Rent and facilities"},
+	{"utilities", "Utilities"},
+	{"supplies", "Office supplies"},
+	{"software", "Software and subscriptions"},
+	{"professional", "Professional services"},
+	{"marketing", "Marketing and advertising"},
+	{"travel", "Travel and meals"},
+	{"insurance", "Insurance"},
+	{"other", "Other"},
+}
+
+func findExpenseCategory(code string) (ExpenseCategory, bool) {
+	for _, c := range expenseCategories {
+		if c.Code == code {
+			return c, true
+		}
+	}
+	return ExpenseCategory{}, false
+}
+
+func (v *Vendor) ExpenseCategoryLabel() string {
+	if c, ok := findExpenseCategory(v.ExpenseCategory); ok {
+		return c.Label
+	}
+	return v.ExpenseCategory
+}
+
+func (v *Vendor) PaymentMethodLabel() string {
+	for _, pm := range paymentMethods {
+		if pm.Value == v.PaymentMethod {
+			return pm.Label
+		}
+	}
+	return v.PaymentMethod
+}
+
+var (
+	phoneChars   = regexp.MustCompile(`^\+?[0-9 ().\-]+( *(x|ext\.?) *[0-9]+)?$`)
+	nonDigits    = regexp.MustCompile(`[^0-9]`)
+	countryCode  = regexp.MustCompile(`^[A-Z]{2}$`)
+	usState      = regexp.MustCompile(`^[A-Z]{2}$`)
+	usZip        = regexp.MustCompile(`^[0-9]{5}(-[0-9]{4})?$`)
+	usEIN        = regexp.MustCompile(`^[0-9]{2}-?[0-9]{7}$`)
+	foreignTaxID = regexp.MustCompile(`^[A-Z0-9][A-Z0-9 .\-/]{2,18}[A-Z0-9]$`)
+)
+
+// compact removes spaces from s and upper cases it, the form account
+// identifiers are stored in.
+func compact(s string) string {
+	return strings.ToUpper(strings.Replace(strings.TrimSpace(s), " ", "", -1))
+}
+
+func (a Address) isUS() bool {
+	return a.Country == "" || a.Country == "US"
+}
+
+// readVendorDetails sets the contact, remittance, tax and payment details of
+// v from the form values f.
+func readVendorDetails(v *Vendor, f url.Values) {
+	field := func(name string) string {
+		return strings.TrimSpace(f.Get(name))
+	}
+
+	v.Email = field("email")
+	v.Phone = field("phone")
+	v.TaxID = strings.ToUpper(field("tax_id"))
+	v.ExpenseCategory = field("expense_category")
+	v.PaymentMethod = field("payment_method")
+
+	v.RemitTo = Address{
+		Line1:      field("remit_line1"),
+		Line2:      field("remit_line2"),
+		City:       field("remit_city"),
+		State:      strings.ToUpper(field("remit_state")),
+		PostalCode: field("remit_postal_code"),
+		Country:    strings.ToUpper(field("remit_country")),
+	}
+
+	v.Bank = BankAccount{
+		BankName:      field("bank_name"),
+		AccountName:   field("account_name"),
+		AccountType:   field("account_type"),
+		RoutingNumber: compact(field("routing_number")),
+		AccountNumber: compact(field("account_number")),
+		IBAN:          compact(field("iban")),
+		BIC:           compact(field("bic")),
+	}
+}
+
+// ValidateDetails returns a list of problems with the contact, remittance,
+// tax and payment details of v.  Every detail is optional except those the
+// payment method needs.
+func (v *Vendor) ValidateDetails() []string {
+	errs := []string{}
+
+	if v.Email != "" {
+		addr, err := mail.ParseAddress(v.Email)
+		if err != nil || addr.Address != v.Email {
+			errs = append(errs, "Email must be a valid email address")
+		}
+	}
+
+	if v.Phone != "" {
+		digits := len(nonDigits.ReplaceAllString(strings.Split(v.Phone, "x")[0], ""))
+		if !phoneChars.MatchString(v.Phone) || digits < 7 || digits > 15 {
+			errs = append(errs, "Phone must be a valid phone number")
+		}
+	}
+
+	errs = append(errs, v.RemitTo.validate()...)
+
+	if v.TaxID != "" {
+		if v.RemitTo.isUS() && !usEIN.MatchString(v.TaxID) {
+			errs = append(errs, "Tax ID must be a 9 digit EIN such as 12-3456789")
+		} else if !v.RemitTo.isUS() && !foreignTaxID.MatchString(v.TaxID) {
+			errs = append(errs, "Tax ID must be 4 to 20 letters and digits")
+		}
+	}
+
+	if v.ExpenseCategory != "" {
+		if _, ok := findExpenseCategory(v.ExpenseCategory); !ok {
+			errs = append(errs, "You must select a valid expense category")
+		}
+	}
+
+	if v.PaymentMethod != "" && !validPaymentMethod(v.PaymentMethod) {
+		errs = append(errs, "You must select a valid payment method")
+	}
+
+	errs = append(errs, v.Bank.validate()...)
+
+	switch v.PaymentMethod {
+	case PaymentMethodCheck:
+		if v.RemitTo.Line1 == "" {
+			errs = append(errs, "A remit-to address is needed to pay by check")
+		}
+	case PaymentMethodACH:
+		if v.Bank.RoutingNumber == "" || v.Bank.AccountNumber == "" {
+			errs = append(errs, "A routing and account number are needed to pay by ACH")
+		}
+	case PaymentMethodWire:
+		if (v.Bank.RoutingNumber == "" || v.Bank.AccountNumber == "") && (v.Bank.IBAN == "" || v.Bank.BIC == "") {
+			errs = append(errs, "A routing and account number or an IBAN and BIC are needed to pay by wire")
+		}
+	}
+
+	return errs
+}
+
+func (a Address) validate() []string {
+	errs := []string{}
+	if a.IsZero() {
+		return errs
+	}
+
+	if a.Line1 == "" || a.City == "" {
+		errs = append(errs, "Remit-to address must have a street and city")
+	}
+
+	if a.Country != "" && !countryCode.MatchString(a.Country) {
+		errs = append(errs, "Remit-to country must be a two letter country code")
+	}
+
+	if a.isUS() {
+		if !usState.MatchString(a.State) {
+			errs = append(errs, "Remit-to state must be a two letter state code")
+		}
+		if !usZip.MatchString(a.PostalCode) {
+			errs = append(errs, "Remit-to ZIP code must be 5 or 9 digits")
+		}
+	}
+
+	return errs
+}
+
+func (b BankAccount) validate() []string {
+	errs := []string{}
+
+	if b.AccountType != "" {
+		valid := false
+		for _, t := range accountTypes {
+			if t.Value == b.AccountType {
+				valid = true
+			}
+		}
+		if !valid {
+			errs = append(errs, "You must select a valid account type")
+		}
+	}
+
+	if b.RoutingNumber != "" && !validABARouting(b.RoutingNumber) {
+		errs = append(errs, "Routing number must be a valid 9 digit ABA routing number")
+	}
+
+	if b.AccountNumber != "" && !validUSAccount(b.AccountNumber) {
+		errs = append(errs, "Account number must be 4 to 17 digits")
+	}
+
+	if (b.RoutingNumber == "") != (b.AccountNumber == "") {
+		errs = append(errs, "Routing and account numbers must be given together")
+	}
+
+	if b.IBAN != "" {
+		if msg := ibanProblem(b.IBAN); msg != "" {
+			errs = append(errs, msg)
+		}
+	}
+
+	if b.BIC != "" && !validBIC(b.BIC) {
+		errs = append(errs, "BIC must be 8 or 11 characters: a bank code, country code, location and optional branch")
+	}
+
+	return errs
+}
@@ -0,0 +1,157 @@
+package billing
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"appengine/datastore"
+)
+
+// VendorMonth holds the bills of a vendor dated in one month.  Amounts are
+// in cents.
+type VendorMonth struct {
+	Month  time.Time
+	Bills  int
+	Billed int
+	Paid   int
+}
+
+type vendorMonths []*VendorMonth
+
+func (m vendorMonths) Len() int           { return len(m) }
+func (m vendorMonths) Less(i, j int) bool { return m[i].Month.After(m[j].Month) }
+func (m vendorMonths) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// VendorStats sums up the bills of a vendor.  AvgDaysToPay is the average
+// number of days from the invoice date to the date a bill was paid in full,
+// over the PaidBills bills that have been.
+type VendorStats struct {
+	Bills        int
+	Billed       int
+	Paid         int
+	Outstanding  int
+	PaidBills    int
+	AvgDaysToPay float64
+	Months       []*VendorMonth
+}
+
+// billDate returns the invoice date of b, or the date it was posted for
+// bills without one.
+func billDate(b *Bill) time.Time {
+	if b.Date.IsZero() {
+		return b.PostedOn
+	}
+	return b.Date
+}
+
+// settledOn returns the date b was paid off, or when it was marked paid
+// for bills paid before that date was kept.
+func settledOn(b *Bill) time.Time {
+	if b.SettledOn.IsZero() {
+		return b.PaidOn
+	}
+	return b.SettledOn
+}
+
+// NewVendorStats computes the totals, average days to pay and monthly spend
+// of bills, newest month first.
+func NewVendorStats(bills []*Bill) *VendorStats {
+	s := &VendorStats{}
+	months := map[time.Time]*VendorMonth{}
+	days := 0.0
+
+	for _, b := range bills {
+		s.Bills++
+		s.Billed += b.Amt
+		s.Paid += b.PaidAmt
+		s.Outstanding += b.Balance()
+
+		date := billDate(b)
+		if paidOn := settledOn(b); b.Paid && !paidOn.IsZero() && !date.IsZero() {
+			s.PaidBills++
+			days += paidOn.Sub(date).Hours() / 24
+		}
+
+		if date.IsZero() {
+			continue
+		}
+
+		month := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+		m, ok := months[month]
+		if !ok {
+			m = &VendorMonth{Month: month}
+			months[month] = m
+			s.Months = append(s.Months, m)
+		}
+		m.Bills++
+		m.Billed += b.Amt
+		m.Paid += b.PaidAmt
+	}
+
+	if s.PaidBills > 0 {
+		s.AvgDaysToPay = days / float64(s.PaidBills)
+	}
+
+	sort.Sort(vendorMonths(s.Months))
+
+	return s
+}
+
+// GetVendorBills returns every bill of v that is not in the trash, newest
+// first.
+func (ctx *Context) GetVendorBills(v *Vendor) ([]*Bill, error) {
+	bills := make([]*Bill, 0, 20)
+	q := datastore.NewQuery("Bill").Filter("VendorKey =", v.Key).Order("-PostedOn")
+	keys, err := ctx.getPageWhere(q, nil, &bills, notDeleted)
+	if err != nil {
+		return bills, err
+	}
+
+	for idx, k := range keys {
+		bills[idx].ID = k.IntID()
+		bills[idx].Key = k
+	}
+
+	return bills, nil
+}
+
+type VendorPage struct {
+	*Vendor
+	Bills       []*Bill
+	Stats       *VendorStats
+	BankChanges []*BankChange
+}
+
+func handleViewVendor(ctx *Context, w http.ResponseWriter, r *http.Request) error {
+	v, err := ctx.GetVendorByID(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+
+	if v.Deleted {
+		return datastore.ErrNoSuchEntity
+	}
+
+	if v.CompanyKey != nil {
+		v.Company = new(Company)
+		err = datastore.Get(ctx.c, v.CompanyKey, v.Company)
+		if err != nil {
+			return err
+		}
+		v.Company.ID = v.CompanyKey.Encode()
+		v.Company.Key = v.CompanyKey
+	}
+
+	bills, err := ctx.GetVendorBills(v)
+	if err != nil {
+		return err
+	}
+
+	changes, err := ctx.GetBankChanges(v)
+	if err != nil {
+		return err
+	}
+
+	return ctx.renderAdmin(viewVendorTmpl, VendorPage{v, bills, NewVendorStats(bills), changes})
+}